@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// requestIDHeader carries the id of a request, given by the client or
+// a proxy in front of the server, or else generated. It is sent back in
+// the response, and appears in the logs about the request.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the length over which a request id given by
+// the client is replaced by a generated one
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withRequestID returns r carrying its request id, taken from the
+// request if it has a usable one or else generated
+func withRequestID(r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		var random [16]byte
+		rand.Read(random[:])
+		id = hex.EncodeToString(random[:])
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// validRequestID tells whether id can be used as is in headers and
+// logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom returns the id of the request
+func requestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// logError logs an error that happened while handling r, along with
+// the id of the request so it can be matched with the access log and
+// what the client saw
+func logError(r *http.Request, v ...interface{}) {
+	log.Println(append([]interface{}{"[" + requestIDFrom(r) + "]"}, v...)...)
+}
+
+// clientIP returns the IP address the request comes from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// accessEntry is a line of the access log
+type accessEntry struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"requestId"`
+	ClientIP      string    `json:"clientIp"`
+	Principal     string    `json:"principal,omitempty"`
+	Method        string    `json:"method"`
+	Name          string    `json:"name,omitempty"`
+	Status        int       `json:"status"`
+	BytesReceived int64     `json:"bytesReceived"`
+	BytesSent     int64     `json:"bytesSent"`
+	Duration      float64   `json:"duration"`
+}
+
+func newAccessEntry(r *http.Request, start time.Time, status int, received, sent int64) accessEntry {
+	if status == 0 {
+		// Nothing was written, which net/http answers with a 200
+		status = http.StatusOK
+	}
+	p, _ := principalFrom(r)
+	return accessEntry{
+		Time:          start.UTC(),
+		RequestID:     requestIDFrom(r),
+		ClientIP:      clientIP(r),
+		Principal:     p.name,
+		Method:        r.Method,
+		Name:          r.URL.Query().Get("name"),
+		Status:        status,
+		BytesReceived: received,
+		BytesSent:     sent,
+		Duration:      time.Since(start).Seconds(),
+	}
+}
+
+// accessLog writes one JSON line per request to a file. The file is
+// reopened on SIGHUP, so that it can be rotated by renaming it then
+// sending the signal.
+type accessLog struct {
+	filename string
+
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File
+}
+
+// newAccessLog opens the access log appending to filename, or writing
+// to stdout if filename is "-"
+func newAccessLog(filename string) (*accessLog, error) {
+	al := &accessLog{filename: filename}
+	if filename == "-" {
+		al.w = os.Stdout
+		return al, nil
+	}
+	return al, al.reopen()
+}
+
+func (al *accessLog) reopen() error {
+	if al.filename == "-" {
+		return nil
+	}
+	f, err := os.OpenFile(al.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.f != nil {
+		al.f.Close()
+	}
+	al.f, al.w = f, f
+	return nil
+}
+
+// watch reopens the file on SIGHUP
+func (al *accessLog) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := al.reopen(); err != nil {
+			log.Println("Couldn't reopen access log:", err)
+		}
+	}
+}
+
+func (al *accessLog) write(e accessEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Couldn't encode access log entry:", err)
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := al.w.Write(append(line, '\n')); err != nil {
+		log.Println("Couldn't write access log:", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// readAccessLog returns the entries of the access log in filename
+func readAccessLog(t *testing.T, filename string) []accessEntry {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []accessEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e accessEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("invalid line %q: %v", sc.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	filename := path.Join(tmp, "access.log")
+	al, err := newAccessLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &tokenAuth{tokens: map[string]principal{hashToken("secret"): {name: "alice", scopes: scopeAdmin}}}
+	ts := httptest.NewServer(handler{st: newDummyStore(), auth: auth, accessLog: al})
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/?name=hello.txt", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set(requestIDHeader, "upload-42")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if id := res.Header.Get(requestIDHeader); id != "upload-42" {
+		t.Fatalf("got request id %q, expected the one sent", id)
+	}
+
+	// Requests without a usable id get one
+	req, _ = http.NewRequest("GET", ts.URL+"/?name=a/missing", nil)
+	req.Header.Set(requestIDHeader, "not\tusable")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	generated := res.Header.Get(requestIDHeader)
+	if len(generated) != 32 {
+		t.Fatalf("got request id %q, expected a generated one", generated)
+	}
+
+	entries := readAccessLog(t, filename)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, expected 2", len(entries))
+	}
+	e := entries[0]
+	if e.RequestID != "upload-42" || e.Method != "POST" || e.Name != "hello.txt" || e.Status != http.StatusCreated ||
+		e.Principal != "alice" || e.ClientIP != "127.0.0.1" || e.BytesReceived != 5 || e.BytesSent == 0 || e.Time.IsZero() {
+		t.Errorf("got entry %+v for the upload", e)
+	}
+	e = entries[1]
+	if e.RequestID != generated || e.Status != http.StatusUnauthorized || e.Principal != "" {
+		t.Errorf("got entry %+v for the unauthenticated request", e)
+	}
+
+	// After the log is moved away and reopened, entries go to a new
+	// file
+	if err := os.Rename(filename, filename+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.Get(ts.URL + "/?name=a/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if n := len(readAccessLog(t, filename+".1")); n != 2 {
+		t.Errorf("got %d entries in the rotated file, expected 2", n)
+	}
+	if n := len(readAccessLog(t, filename)); n != 1 {
+		t.Errorf("got %d entries in the new file, expected 1", n)
+	}
+}
+
+func TestLogErrorRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	r := httptest.NewRequest("GET", "/?name=a/b", nil)
+	r.Header.Set(requestIDHeader, "abc")
+	logError(withRequestID(r), "Error reading:", "oops")
+	if !strings.Contains(buf.String(), "[abc] Error reading: oops") {
+		t.Fatalf("got log %q, expected the request id", buf.String())
+	}
+}
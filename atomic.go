@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// tmpDirName is the directory under a store's root where files are
+// written before being renamed to their final path. Its name isn't 2
+// characters long, so it is never mistaken for a fanout directory.
+const tmpDirName = "tmp"
+
+// faultHook is called between the steps of writing a file, with the
+// name of the step just done, and the write fails with the error it
+// returns. It returns nil, except in tests that make it fail or panic
+// to simulate an error or a crash at that point.
+var faultHook = func(step string) error { return nil }
+
+// tempFile creates a new temporary file in the store under root
+func tempFile(root string) (*os.File, error) {
+	dir := path.Join(root, tmpDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, "")
+}
+
+// commitFile makes the temporary file f durable and moves it to
+// filename, so that filename either doesn't exist or has the whole
+// content, even after a crash. f is closed, and removed on error. If
+// modTime isn't zero, it is set on the file before it appears. If an
+// error happens once filename appeared, it is left in place: removing
+// it is up to the caller, who knows whether it was there before.
+func commitFile(root string, f *os.File, filename string, modTime time.Time) (err error) {
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := faultHook("synced"); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(f.Name(), modTime, modTime); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return err
+	}
+	if err := faultHook("renamed"); err != nil {
+		return err
+	}
+	return syncDirs(root, path.Dir(filename))
+}
+
+// writeFileAtomic writes content to filename through a temporary file,
+// see commitFile
+func writeFileAtomic(root, filename string, content []byte, modTime time.Time) error {
+	f, err := tempFile(root)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = faultHook("written")
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return commitFile(root, f, filename, modTime)
+}
+
+// syncDirs fsyncs dir and all its parents up to root, so that the
+// entries created in them, including dir itself, survive a crash
+func syncDirs(root, dir string) error {
+	for {
+		d, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		err = d.Sync()
+		d.Close()
+		if err != nil {
+			return err
+		}
+		if len(dir) <= len(root) {
+			return nil
+		}
+		dir = path.Dir(dir)
+	}
+}
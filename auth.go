@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// scope is a set of permissions granted to a token
+type scope uint
+
+const (
+	scopeUpload scope = 1 << iota
+	scopeRead
+	scopeDelete
+	scopeAdmin
+)
+
+var scopeNames = map[string]scope{
+	"upload": scopeUpload,
+	"read":   scopeRead,
+	"delete": scopeDelete,
+	"admin":  scopeAdmin,
+}
+
+// allows tells whether s grants the permissions in wanted. The admin
+// scope grants everything.
+func (s scope) allows(wanted scope) bool {
+	return s&scopeAdmin != 0 || s&wanted == wanted
+}
+
+// principal is whoever a token has been handed to
+type principal struct {
+	name   string
+	scopes scope
+
+	// maxUploadSize overrides the server's maximum upload size if not 0
+	maxUploadSize int64
+}
+
+// tokenAuth authenticates requests with bearer tokens. Tokens are
+// never stored in clear: the tokens file only contains their sha256,
+// so that reading it isn't enough to impersonate anyone.
+type tokenAuth struct {
+	// hex-encoded sha256 of the token to the principal it belongs to
+	tokens map[string]principal
+
+	// subject of a verified client certificate to the principal it
+	// belongs to
+	subjects map[string]principal
+}
+
+// loadTokens reads the tokens file. Each line defines a token as the
+// name of the principal, the hex-encoded sha256 of the token and a
+// comma-separated list of scopes, separated by spaces, optionally
+// followed by the maximum size of their uploads, eg:
+//
+//	alice 2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b upload,read
+//	bob   b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c upload 100M
+//
+// Empty lines and lines starting with # are ignored.
+func loadTokens(filename string) (*tokenAuth, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ta := &tokenAuth{tokens: make(map[string]principal)}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: expected 3 or 4 fields, got %d", filename, lineno, len(fields))
+		}
+		hash := strings.ToLower(fields[1])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid sha256 %q", filename, lineno, fields[1])
+		}
+		p := principal{name: fields[0]}
+		if p.scopes, err = parseScopes(fields[2]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		if len(fields) == 4 {
+			size, err := parseSize(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+			}
+			p.maxUploadSize = size
+		}
+		if _, ok := ta.tokens[hash]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate token", filename, lineno)
+		}
+		ta.tokens[hash] = p
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ta, nil
+}
+
+// parseScopes parses a comma-separated list of scopes
+func parseScopes(list string) (scope, error) {
+	var scopes scope
+	for _, name := range strings.Split(list, ",") {
+		s, ok := scopeNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown scope %q", name)
+		}
+		scopes |= s
+	}
+	return scopes, nil
+}
+
+// authenticate returns the principal owning the bearer token in the
+// Authorization header, if any, or else the one owning the verified
+// client certificate
+func (ta *tokenAuth) authenticate(r *http.Request) (p principal, ok bool) {
+	const prefix = "bearer "
+	header := r.Header.Get("Authorization")
+	if header == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		p, ok = ta.subjects[r.TLS.VerifiedChains[0][0].Subject.String()]
+		return p, ok
+	}
+	if len(header) <= len(prefix) || strings.ToLower(header[:len(prefix)]) != prefix {
+		return principal{}, false
+	}
+	hash := sha256.Sum256([]byte(strings.TrimSpace(header[len(prefix):])))
+	p, ok = ta.tokens[hex.EncodeToString(hash[:])]
+	return p, ok
+}
+
+// requiredScope returns the scope needed to perform the request
+func requiredScope(r *http.Request) scope {
+	if isSignRequest(r) || isStatsRequest(r) {
+		return scopeAdmin
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		return scopeRead
+	case "DELETE":
+		// Aborting an upload session is part of uploading
+		if isUploadRequest(r) {
+			return scopeUpload
+		}
+		return scopeDelete
+	default:
+		return scopeUpload
+	}
+}
+
+type principalKey struct{}
+
+// principalFrom returns the principal that made the request, if the
+// request has been authenticated
+func principalFrom(r *http.Request) (p principal, ok bool) {
+	p, ok = r.Context().Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// authorize checks that the request carries a token allowed to perform
+// it. If not, an error is sent to the client and false is returned;
+// otherwise the returned request carries the principal.
+func (h handler) authorize(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	p, ok := h.auth.authenticate(r)
+	if !ok {
+		challenge := `Bearer realm="httpfile"`
+		if r.Header.Get("Authorization") != "" {
+			challenge += `, error="invalid_token"`
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return r, false
+	}
+	if !p.scopes.allows(requiredScope(r)) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="httpfile", error="insufficient_scope"`)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p)), true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func writeTokens(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "httpfile-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadTokens(t *testing.T) {
+	for _, invalid := range []string{
+		"alice " + hashToken("a") + "\n",
+		"alice notahash upload\n",
+		"alice " + hashToken("a") + " upload,fly\n",
+		"alice " + hashToken("a") + " upload\nbob " + hashToken("a") + " read\n",
+	} {
+		filename := writeTokens(t, invalid)
+		if _, err := loadTokens(filename); err == nil {
+			t.Errorf("expected error for tokens file %q", invalid)
+		}
+		os.Remove(filename)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	filename := writeTokens(t, `# test tokens
+reader `+hashToken("reader-token")+` read
+uploader `+hashToken("uploader-token")+` upload,read
+
+admin `+hashToken("admin-token")+` admin
+`)
+	defer os.Remove(filename)
+	auth, err := loadTokens(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(handler{st: newDummyStore(), auth: auth})
+	defer ts.Close()
+
+	do := func(method, rawQuery, token string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+"/?"+rawQuery, strings.NewReader("content"))
+		req.Header.Set("Content-Type", "text/plain")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	for _, tc := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong-token", http.StatusUnauthorized},
+		{"reader-token", http.StatusForbidden},
+	} {
+		res := do("POST", "name=content.txt", tc.token)
+		if res.StatusCode != tc.status {
+			t.Fatalf("[POST with %q] got status %d, expected %d", tc.token, res.StatusCode, tc.status)
+		}
+		if res.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("[POST with %q] no WWW-Authenticate header", tc.token)
+		}
+	}
+
+	res := do("POST", "name=content.txt", "uploader-token")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("[POST] got status %d, expected %d", res.StatusCode, http.StatusCreated)
+	}
+	location, _ := url.Parse(res.Header.Get("Location"))
+	query := location.RawQuery
+
+	for _, token := range []string{"reader-token", "uploader-token", "admin-token"} {
+		if res := do("GET", query, token); res.StatusCode != http.StatusOK {
+			t.Fatalf("[GET with %q] got status %d, expected %d", token, res.StatusCode, http.StatusOK)
+		}
+	}
+
+	if res := do("DELETE", query, "uploader-token"); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("[DELETE with uploader token] got status %d, expected %d", res.StatusCode, http.StatusForbidden)
+	}
+	if res := do("DELETE", query, "admin-token"); res.StatusCode != http.StatusOK {
+		t.Fatalf("[DELETE with admin token] got status %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	// The UI page itself is public, it only calls the API
+	res, err = http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("[UI] got status %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// config is everything the server can be configured with. It is read
+// from an optional JSON config file, then from the command line flags,
+// which take precedence. The JSON keys are the same as the flags, in
+// camel case.
+type config struct {
+	// Listen is the list of addresses to listen on
+	Listen []string `json:"listen"`
+
+	// Store is the backend the files are stored in, "dedup" or "fs",
+	// under Root; Uploads is where multi-part uploads are kept until
+	// they are complete, or for UploadExpiry at most, as a duration (eg
+	// "24h"), 0 meaning forever
+	Store        string `json:"store"`
+	Root         string `json:"root"`
+	Uploads      string `json:"uploads"`
+	UploadExpiry string `json:"uploadExpiry"`
+
+	// ChunkBits sets the average size of the chunks of a dedup store,
+	// 2^ChunkBits bytes. Changing it means content stored before isn't
+	// deduplicated with content stored after.
+	ChunkBits uint `json:"chunkBits"`
+
+	// TLSCert and TLSKey are the certificate and key files to serve
+	// HTTPS with; if empty, plain HTTP is served
+	TLSCert string `json:"tlsCert"`
+	TLSKey  string `json:"tlsKey"`
+
+	// TLSClientCA is the file with the CAs client certificates must be
+	// signed by, and ClientCerts the file mapping their subjects to
+	// principals; if empty, clients can't authenticate with a
+	// certificate
+	TLSClientCA string `json:"tlsClientCA"`
+	ClientCerts string `json:"clientCerts"`
+
+	// RedirectHTTP is an address on which plain HTTP requests are
+	// redirected to HTTPS
+	RedirectHTTP string `json:"redirectHTTP"`
+
+	Tokens      string `json:"tokens"`
+	SigningKeys string `json:"signingKeys"`
+	Quotas      string `json:"quotas"`
+
+	// Sizes and rates in bytes take an optional K, M, G or T suffix, -
+	// means no limit
+	MaxUploadSize        string  `json:"maxUploadSize"`
+	Rate                 float64 `json:"rate"`
+	Burst                int     `json:"burst"`
+	UploadRate           string  `json:"uploadRate"`
+	MaxConcurrentUploads int     `json:"maxConcurrentUploads"`
+
+	// DiskReserve is the free space on the filesystem of Root that
+	// uploads can't use
+	DiskReserve string `json:"diskReserve"`
+
+	// ReadyMinFree is the free space on the filesystem of Root under
+	// which the server isn't ready
+	ReadyMinFree string `json:"readyMinFree"`
+
+	// KeepVersions is how many versions of each stable name are kept,
+	// and KeepVersionsDays for how many days; 0 means no limit
+	KeepVersions     int `json:"keepVersions"`
+	KeepVersionsDays int `json:"keepVersionsDays"`
+
+	// LogFile is the file logs are appended to; if empty, they go to
+	// stderr
+	LogFile string `json:"logFile"`
+
+	// AccessLog is the file a JSON line is appended to for each request,
+	// "-" for stdout; if empty, requests are not logged
+	AccessLog string `json:"accessLog"`
+
+	// ShutdownTimeout is how long requests in flight are given to finish
+	// when the server is asked to stop, as a duration (eg "30s")
+	ShutdownTimeout string `json:"shutdownTimeout"`
+}
+
+func defaultConfig() config {
+	return config{
+		Listen:        []string{":8080"},
+		Store:         "dedup",
+		Root:          "data",
+		Uploads:       "uploads",
+		UploadExpiry:  "24h",
+		ChunkBits:     blobBits,
+		MaxUploadSize: "-",
+		Burst:         10,
+		UploadRate:    "-",
+		DiskReserve:   "100M",
+		ReadyMinFree:  "100M",
+		// Stay under the 30s of SIGTERM grace most supervisors give
+		ShutdownTimeout: "25s",
+	}
+}
+
+// listFlag is a flag that can be given several times to build a list.
+// The first time it is given, it replaces the default list.
+type listFlag struct {
+	list *[]string
+	set  bool
+}
+
+func (lf *listFlag) String() string {
+	if lf.list == nil {
+		return ""
+	}
+	return strings.Join(*lf.list, ",")
+}
+
+func (lf *listFlag) Set(value string) error {
+	if !lf.set {
+		*lf.list = nil
+		lf.set = true
+	}
+	*lf.list = append(*lf.list, value)
+	return nil
+}
+
+// flagSet returns the flags setting the fields of c, along with the
+// flags that are not part of the configuration itself
+func (c *config) flagSet(configFile *string, printConfig *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet("httpfile", flag.ContinueOnError)
+	fs.StringVar(configFile, "config", "", "JSON file to read the configuration from; flags take precedence over it")
+	fs.BoolVar(printConfig, "print-config", false, "print the configuration as JSON and exit")
+
+	fs.Var(&listFlag{list: &c.Listen}, "listen", "address to listen on; can be given several times")
+	fs.StringVar(&c.Store, "store", c.Store, `store backend, "dedup" or "fs"`)
+	fs.StringVar(&c.Root, "root", c.Root, "directory files are stored in")
+	fs.StringVar(&c.Uploads, "uploads", c.Uploads, "directory multi-part uploads are kept in until complete")
+	fs.StringVar(&c.UploadExpiry, "upload-expiry", c.UploadExpiry, "how long multi-part uploads are kept if not completed; 0 means forever")
+	fs.UintVar(&c.ChunkBits, "chunk-bits", c.ChunkBits, "average size of the chunks of a dedup store, as a power of 2")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "certificate file to serve HTTPS with")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "key file to serve HTTPS with")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "file with the CAs client certificates must be signed by")
+	fs.StringVar(&c.ClientCerts, "client-certs", c.ClientCerts, "file mapping the subjects of client certificates to principals")
+	fs.StringVar(&c.RedirectHTTP, "redirect-http", c.RedirectHTTP, "address on which to redirect plain HTTP to HTTPS")
+	fs.StringVar(&c.Tokens, "tokens", c.Tokens, "file with the tokens allowed to access the server; if empty, no authentication is done")
+	fs.StringVar(&c.SigningKeys, "signing-keys", c.SigningKeys, "file with the keys used to sign URLs; if empty, signed URLs are refused")
+	fs.StringVar(&c.Quotas, "quotas", c.Quotas, "file with the storage quotas of each user; if empty, there is no quota")
+	fs.StringVar(&c.MaxUploadSize, "max-upload-size", c.MaxUploadSize, "maximum size of an upload, with an optional K, M, G or T suffix; - means no limit")
+	fs.Float64Var(&c.Rate, "rate", c.Rate, "requests per second allowed for each client; 0 means no limit")
+	fs.IntVar(&c.Burst, "burst", c.Burst, "requests each client can make at once above the rate")
+	fs.StringVar(&c.UploadRate, "upload-rate", c.UploadRate, "bytes per second each client can upload, with an optional K, M, G or T suffix; - means no limit")
+	fs.IntVar(&c.MaxConcurrentUploads, "max-concurrent-uploads", c.MaxConcurrentUploads, "uploads each client can run at the same time; 0 means no limit")
+	fs.StringVar(&c.DiskReserve, "disk-reserve", c.DiskReserve, "free space on the filesystem of the root that uploads can't use, with an optional K, M, G or T suffix; - means none")
+	fs.StringVar(&c.ReadyMinFree, "ready-min-free", c.ReadyMinFree, "free space on the filesystem of the root under which /readyz fails, with an optional K, M, G or T suffix; - means no minimum")
+	fs.IntVar(&c.KeepVersions, "keep-versions", c.KeepVersions, "versions of each stable name kept, including the current one; 0 means all")
+	fs.IntVar(&c.KeepVersionsDays, "keep-versions-days", c.KeepVersionsDays, "days old versions of stable names are kept for; 0 means forever")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "file to append logs to; if empty, they go to stderr")
+	fs.StringVar(&c.AccessLog, "access-log", c.AccessLog, "file to append a JSON line to for each request, - for stdout; reopened on SIGHUP")
+	fs.StringVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long requests in flight are given to finish on SIGTERM or SIGINT")
+	return fs
+}
+
+// parseConfig builds the configuration from the command line arguments
+// and the config file they point to, if any, and validates it
+func parseConfig(args []string) (c config, printConfig bool, err error) {
+	var configFile string
+	c = defaultConfig()
+	if err := c.flagSet(&configFile, &printConfig).Parse(args); err != nil {
+		return c, false, err
+	}
+	if configFile != "" {
+		// Flags are parsed again, so that they override the file
+		c = defaultConfig()
+		if err := loadConfigFile(configFile, &c); err != nil {
+			return c, false, err
+		}
+		fs := c.flagSet(&configFile, &printConfig)
+		fs.SetOutput(new(strings.Builder))
+		fs.Parse(args)
+	}
+	return c, printConfig, c.validate()
+}
+
+// loadConfigFile reads the JSON config file into c. Unknown keys are
+// errors, as they are most likely typos.
+func loadConfigFile(filename string, c *config) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+// validate checks the configuration, reporting all problems at once
+func (c config) validate() error {
+	var problems []string
+	if len(c.Listen) == 0 {
+		problems = append(problems, "no address to listen on")
+	}
+	if c.Store != "dedup" && c.Store != "fs" {
+		problems = append(problems, fmt.Sprintf("unknown store %q", c.Store))
+	}
+	if c.Root == "" {
+		problems = append(problems, "empty root")
+	}
+	if c.Uploads == "" {
+		problems = append(problems, "empty uploads directory")
+	}
+	if c.ChunkBits < 8 || c.ChunkBits > 24 {
+		problems = append(problems, fmt.Sprintf("chunk bits %d out of range [8, 24]", c.ChunkBits))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		problems = append(problems, "TLS needs both a certificate and a key")
+	}
+	if c.TLSCert == "" && (c.TLSClientCA != "" || c.RedirectHTTP != "") {
+		problems = append(problems, "client certificates and redirection need TLS")
+	}
+	if (c.TLSClientCA == "") != (c.ClientCerts == "") {
+		problems = append(problems, "client certificates need both CAs and subjects")
+	}
+	for _, addr := range append(c.Listen, c.RedirectHTTP) {
+		if _, _, err := net.SplitHostPort(addr); addr != "" && err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if _, err := parseSize(c.MaxUploadSize); err != nil {
+		problems = append(problems, "max upload size: "+err.Error())
+	}
+	if _, err := parseSize(c.UploadRate); err != nil {
+		problems = append(problems, "upload rate: "+err.Error())
+	}
+	if _, err := parseSize(c.DiskReserve); err != nil {
+		problems = append(problems, "disk reserve: "+err.Error())
+	}
+	if _, err := parseSize(c.ReadyMinFree); err != nil {
+		problems = append(problems, "ready min free: "+err.Error())
+	}
+	if c.Rate < 0 || c.Burst < 0 || c.MaxConcurrentUploads < 0 {
+		problems = append(problems, "negative rate limit")
+	}
+	if c.KeepVersions < 0 || c.KeepVersionsDays < 0 {
+		problems = append(problems, "negative version retention")
+	}
+	if d, err := time.ParseDuration(c.UploadExpiry); err != nil || d < 0 {
+		problems = append(problems, fmt.Sprintf("invalid upload expiry %q", c.UploadExpiry))
+	}
+	if d, err := time.ParseDuration(c.ShutdownTimeout); err != nil || d < 0 {
+		problems = append(problems, fmt.Sprintf("invalid shutdown timeout %q", c.ShutdownTimeout))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (c config) shutdownTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.ShutdownTimeout)
+	return d
+}
+
+func (c config) uploadExpiry() time.Duration {
+	d, _ := time.ParseDuration(c.UploadExpiry)
+	return d
+}
+
+// newStore returns the store selected by the configuration
+func (c config) newStore() store {
+	if c.Store == "fs" {
+		return fsStore{c.Root}
+	}
+	return dedupStore{root: c.Root, splitBits: uint32(c.ChunkBits)}
+}
+
+// newHandler builds the handler serving the configuration, loading all
+// the files it points to
+func (c config) newHandler() (handler, error) {
+	st := c.newStore()
+	u, err := newUsage(st)
+	if err != nil {
+		return handler{}, fmt.Errorf("Couldn't compute storage usage: %v", err)
+	}
+	if ds, ok := st.(dedupStore); ok {
+		size, err := ds.chunkBytes()
+		if err != nil {
+			return handler{}, fmt.Errorf("Couldn't measure chunks: %v", err)
+		}
+		metrics.chunkBytesStored(size)
+	}
+	h := handler{
+		st:      accountingStore{st, u},
+		uploads: uploadSessions{c.Uploads},
+		usage:   u,
+	}
+	h.maxUploadSize, _ = parseSize(c.MaxUploadSize)
+	uploadRate, _ := parseSize(c.UploadRate)
+	if reserve, _ := parseSize(c.DiskReserve); reserve > 0 {
+		h.disk = newDiskGuard(c.Root, reserve)
+	}
+	h.retention = retention{
+		keep:    c.KeepVersions,
+		keepFor: time.Duration(c.KeepVersionsDays) * 24 * time.Hour,
+	}
+	h.readiness = &readiness{root: c.Root}
+	h.readiness.minFree, _ = parseSize(c.ReadyMinFree)
+	if c.Rate > 0 || uploadRate > 0 || c.MaxConcurrentUploads > 0 {
+		h.limiter = newRateLimiter(c.Rate, c.Burst, uploadRate, c.MaxConcurrentUploads)
+	}
+	if c.Tokens != "" {
+		if h.auth, err = loadTokens(c.Tokens); err != nil {
+			return handler{}, fmt.Errorf("Couldn't load tokens: %v", err)
+		}
+	}
+	if c.ClientCerts != "" {
+		if h.auth == nil {
+			// Only certificates are accepted
+			h.auth = &tokenAuth{tokens: make(map[string]principal)}
+		}
+		if err := loadClientCerts(c.ClientCerts, h.auth); err != nil {
+			return handler{}, fmt.Errorf("Couldn't load client certificates: %v", err)
+		}
+	}
+	if c.AccessLog != "" {
+		if h.accessLog, err = newAccessLog(c.AccessLog); err != nil {
+			return handler{}, fmt.Errorf("Couldn't open access log: %v", err)
+		}
+	}
+	if c.SigningKeys != "" {
+		if h.signer, err = loadSigningKeys(c.SigningKeys); err != nil {
+			return handler{}, fmt.Errorf("Couldn't load signing keys: %v", err)
+		}
+	}
+	if c.Quotas != "" {
+		if h.quotas, err = loadQuotas(c.Quotas); err != nil {
+			return handler{}, fmt.Errorf("Couldn't load quotas: %v", err)
+		}
+	}
+	return h, nil
+}
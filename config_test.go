@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "httpfile-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestParseConfig(t *testing.T) {
+	filename := writeConfig(t, `{"store": "fs", "root": "/srv/files", "listen": [":80", ":8080"], "maxUploadSize": "1G"}`)
+	defer os.Remove(filename)
+
+	c, printConfig, err := parseConfig([]string{"-config", filename, "-root", "/srv/other", "-print-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig {
+		t.Fatal("print-config not set")
+	}
+	// Flags take precedence over the file, which takes precedence over
+	// the defaults
+	if c.Root != "/srv/other" || c.Store != "fs" || c.MaxUploadSize != "1G" || c.Uploads != "uploads" {
+		t.Fatalf("got config %+v, expected a mix of flags, file and defaults", c)
+	}
+	if !reflect.DeepEqual(c.Listen, []string{":80", ":8080"}) {
+		t.Fatalf("got listen %v, expected the file's", c.Listen)
+	}
+
+	// Giving a list flag replaces the default or the file's list
+	c, _, err = parseConfig([]string{"-config", filename, "-listen", ":1", "-listen", ":2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Listen, []string{":1", ":2"}) {
+		t.Fatalf("got listen %v, expected the flags'", c.Listen)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	filename := writeConfig(t, `{"stor": "fs"}`)
+	defer os.Remove(filename)
+	if _, _, err := parseConfig([]string{"-config", filename}); err == nil || !strings.Contains(err.Error(), "stor") {
+		t.Fatalf("got %v for unknown key, expected an error about it", err)
+	}
+
+	// All problems are reported at once
+	_, _, err := parseConfig([]string{"-store", "s3", "-tls-key", "key.pem", "-upload-rate", "fast"})
+	if err == nil {
+		t.Fatal("got no error for invalid config")
+	}
+	for _, expected := range []string{"s3", "TLS", "upload rate"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %q, expected it to mention %q", err, expected)
+		}
+	}
+}
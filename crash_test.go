@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// crash is what faultHook panics with to simulate a crash
+type crash struct {
+	step string
+}
+
+// postCrashing posts content to st, crashing at the n-th step of
+// writing files. It tells whether the crash happened, ie whether there
+// were at least n steps.
+func postCrashing(t *testing.T, st store, content []byte, n int) (crashed bool) {
+	steps := 0
+	faultHook = func(step string) error {
+		steps++
+		if steps == n {
+			panic(crash{step})
+		}
+		return nil
+	}
+	defer func() {
+		faultHook = func(string) error { return nil }
+		if r := recover(); r != nil {
+			if _, ok := r.(crash); !ok {
+				panic(r)
+			}
+			crashed = true
+		}
+	}()
+	if _, err := st.Post("content.bin", bytes.NewReader(content), time.Now(), meta{}); err != nil {
+		t.Fatal(err)
+	}
+	return false
+}
+
+// checkConsistency makes sure that every object visible in st has the
+// expected content, and that every chunk has the content its name says
+func checkConsistency(t *testing.T, st store, root string, content []byte) {
+	err := st.Walk(func(name string, m meta) error {
+		rd, _, err := st.Get(name)
+		if err != nil {
+			t.Errorf("%s is listed but can't be read: %v", name, err)
+			return nil
+		}
+		got, err := ioutil.ReadAll(rd)
+		rd.Close()
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s has %d bytes (err=%v), expected the %d bytes posted", name, len(got), err, len(content))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(root, p)
+		hash := path.Dir(rel) + path.Base(rel)
+		if err != nil || info.IsDir() || len(hash) != 2*sha256.Size {
+			return nil
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil
+		}
+		chunk, _ := ioutil.ReadFile(p)
+		if sum := sha256.Sum256(chunk); hex.EncodeToString(sum[:]) != hash {
+			t.Errorf("chunk %s is corrupt", hash)
+		}
+		return nil
+	})
+}
+
+// TestCrashConsistency simulates a crash at every step of a Post, and
+// checks that the store is consistent after each of them: no truncated
+// object or chunk is ever visible, and posting the same content again
+// gives it back whole.
+func TestCrashConsistency(t *testing.T) {
+	content := make([]byte, 200000)
+	rand.New(rand.NewSource(4)).Read(content)
+
+	withStores(t, func(t *testing.T, st store, root string) {
+		n := 1
+		for ; postCrashing(t, st, content, n); n++ {
+			checkConsistency(t, st, root, content)
+		}
+		if n < 4 {
+			t.Fatalf("only %d steps where a crash can happen, expected more", n-1)
+		}
+
+		// After all these crashes, the content can still be stored and
+		// read back whole
+		name, err := st.Post("content.bin", bytes.NewReader(content), time.Now(), meta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkConsistency(t, st, root, content)
+		if _, err := st.Meta(name); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// postFailing posts content to st, making the n-th step of writing
+// files fail. It tells whether the failure happened.
+func postFailing(t *testing.T, st store, content []byte, n int) (failed bool) {
+	injected := errors.New("injected failure")
+	steps := 0
+	faultHook = func(step string) error {
+		steps++
+		if steps == n {
+			return injected
+		}
+		return nil
+	}
+	defer func() { faultHook = func(string) error { return nil } }()
+	_, err := st.Post("content.bin", bytes.NewReader(content), time.Now(), meta{})
+	if steps < n {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return false
+	}
+	if err != injected {
+		t.Fatalf("got error %v at step %d, expected the injected one", err, n)
+	}
+	return true
+}
+
+// storedFiles returns all the files under root
+func storedFiles(t *testing.T, root string) []string {
+	var files []string
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(root, p)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files
+}
+
+// failingReader fails once n bytes have been read, like a client going
+// away in the middle of an upload
+type failingReader struct {
+	rd io.Reader
+	n  int
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > fr.n {
+		p = p[:fr.n]
+	}
+	n, err := fr.rd.Read(p)
+	fr.n -= n
+	return n, err
+}
+
+// TestPostFailureCleanup makes a Post fail at every step, and checks
+// that nothing is left behind by any of them
+func TestPostFailureCleanup(t *testing.T) {
+	content := make([]byte, 200000)
+	rand.New(rand.NewSource(4)).Read(content)
+
+	withStores(t, func(t *testing.T, st store, root string) {
+		n := 1
+		for ; postFailing(t, st, content, n); n++ {
+			if files := storedFiles(t, root); len(files) > 0 {
+				t.Fatalf("failure at step %d left %v", n, files)
+			}
+		}
+		if n < 4 {
+			t.Fatalf("only %d steps where a failure can happen, expected more", n-1)
+		}
+
+		// The last Post succeeded; what it stored must not be touched
+		before := storedFiles(t, root)
+		for _, size := range []int{0, 1000, 100000} {
+			rd := &failingReader{bytes.NewReader(content[1:]), size}
+			if _, err := st.Post("content.bin", rd, time.Now(), meta{}); err == nil {
+				t.Fatalf("upload cut after %d bytes succeeded", size)
+			}
+			if files := storedFiles(t, root); !reflect.DeepEqual(files, before) {
+				t.Fatalf("upload cut after %d bytes left %v, expected %v", size, files, before)
+			}
+		}
+	})
+}
@@ -8,10 +8,12 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,10 +36,82 @@ import (
 // stellar.
 type dedupStore struct {
 	root string
+
+	// splitBits is the number of bits of the rolling checksum that
+	// decide chunk boundaries, making chunks 2^splitBits bytes long on
+	// average; 0 means blobBits
+	splitBits uint32
 }
 
 var _ store = dedupStore{}
 
+// chunkLock prevents chunks from being collected while an object
+// referencing them is being written: Post holds it for reading while it
+// writes the object and unpins its chunks, Collect holds it for
+// writing. Collect thus sees either the object or the chunks pinned.
+var chunkLock sync.RWMutex
+
+// chunkPins keeps the chunks used by uploads in progress from being
+// collected, without blocking Collect for as long as they read their
+// content. An upload pins each of its chunks as it checks whether it
+// exists, and unpins them once the object is written or it has failed.
+var chunkPins = struct {
+	sync.Mutex
+	pins map[string]*chunkPin
+}{pins: make(map[string]*chunkPin)}
+
+type chunkPin struct {
+	count int
+
+	// shared is set when another upload pinned the chunk while it was
+	// already pinned, and may have used it since
+	shared bool
+}
+
+// pinChunk pins a chunk and tells whether it is already stored
+func (ds dedupStore) pinChunk(hash string) (exists bool) {
+	chunkPins.Lock()
+	defer chunkPins.Unlock()
+	p := chunkPins.pins[hash]
+	if p == nil {
+		p = &chunkPin{}
+		chunkPins.pins[hash] = p
+	} else {
+		p.shared = true
+	}
+	p.count++
+	_, err := os.Stat(path.Join(ds.root, hash[:2], hash[2:]))
+	return err == nil
+}
+
+// unpinChunks unpins the chunks of an upload. Those it wrote are given
+// in discard if it failed, and are removed unless another upload may
+// have used them; Collect gets the others.
+func (ds dedupStore) unpinChunks(pinned, discard map[string]bool) {
+	chunkPins.Lock()
+	defer chunkPins.Unlock()
+	for hash := range pinned {
+		p := chunkPins.pins[hash]
+		p.count--
+		if p.count > 0 {
+			continue
+		}
+		delete(chunkPins.pins, hash)
+		if discard[hash] && !p.shared {
+			chunkpath := path.Join(ds.root, hash[:2], hash[2:])
+			info, err := os.Stat(chunkpath)
+			if err == nil {
+				err = os.Remove(chunkpath)
+			}
+			if err == nil {
+				metrics.chunkRemoved(info.Size())
+			} else if !os.IsNotExist(err) {
+				log.Println("Couldn't remove chunk of failed upload:", err)
+			}
+		}
+	}
+}
+
 // randomPath generates a random path from dedupStore's root to the
 // name, inserting a random string in the middle to avoid overwriting
 // other files with the same name and prevent url-guessing.
@@ -55,32 +129,73 @@ func (ds dedupStore) randomPath(name string) string {
 	return path.Join(ds.root, randomString[:2], randomString[2:], filename)
 }
 
-func (ds dedupStore) Post(name string, rd io.Reader, modTime time.Time) (newpath string, err error) {
+// Post stores the content. If that fails, eg because the client went
+// away, the chunks it wrote are removed so that nothing is left behind,
+// unless another upload may have used them in the meantime.
+func (ds dedupStore) Post(name string, rd io.Reader, modTime time.Time, m meta) (newpath string, err error) {
+	// The chunks are unpinned however the upload ends, but only removed
+	// when it returns an error; once it succeeded, pinned is nil
+	pinned := make(map[string]bool)
+	written := make(map[string]bool)
+	defer func() {
+		if err == nil {
+			written = nil
+		}
+		ds.unpinChunks(pinned, written)
+	}()
+
 	chunks := make(chan chunk)
 	errorChan := make(chan error)
 	done := make(chan struct{})
-	go doRoll(rd, chunks, errorChan, done)
+	bits := ds.splitBits
+	if bits == 0 {
+		bits = blobBits
+	}
+	go doRoll(rd, bits, chunks, errorChan, done)
+	// If we give up early, doRoll must still be able to finish
+	defer func() {
+		if err != nil {
+			go func() {
+				for {
+					select {
+					case <-chunks:
+					case <-errorChan:
+					case <-done:
+						return
+					}
+				}
+			}()
+		}
+	}()
 
 	// We chunk the content, storing chunks one by one if they don't
 	// already exist in the filesystem, and gather chunk hashes in a list
 	// for later storing in the metadata file
 	chunkList := make([]string, 0)
+	m.Size, m.NewBytes = 0, 0
 loop:
 	for {
 		select {
 		case chunk := <-chunks:
 			chunkList = append(chunkList, chunk.hash)
-			chunkpath := path.Join(ds.root, chunk.hash[:2], chunk.hash[2:])
-			if _, err := os.Stat(chunkpath); err == nil {
+			m.Size += int64(len(chunk.content))
+			if pinned[chunk.hash] || ds.pinChunk(chunk.hash) {
+				pinned[chunk.hash] = true
 				// chunk already exists, no need to store it again
+				metrics.chunk(len(chunk.content), false)
 				continue
 			}
-			if err := os.MkdirAll(path.Dir(chunkpath), 0755); err != nil {
-				return "", err
-			}
-			if err := ioutil.WriteFile(chunkpath, chunk.content, 0600); err != nil {
+			// A chunk is written atomically: a corrupt one would corrupt
+			// every file deduplicated against it. It is counted as
+			// written even if that fails, since it may have been
+			// renamed already.
+			pinned[chunk.hash], written[chunk.hash] = true, true
+			chunkpath := path.Join(ds.root, chunk.hash[:2], chunk.hash[2:])
+			if err := writeFileAtomic(ds.root, chunkpath, chunk.content, time.Time{}); err != nil {
 				return "", err
 			}
+			m.NewBytes += int64(len(chunk.content))
+			metrics.chunk(len(chunk.content), true)
 		case err := <-errorChan:
 			return "", err
 		case <-done:
@@ -94,29 +209,26 @@ loop:
 	// time. The full path is generated randomly to allow multiple files
 	// to have the same name but different identities (and since we dedupe
 	// the content, it's not *that* expensive)
+	chunkLock.RLock()
+	defer chunkLock.RUnlock()
 	filepath := ds.randomPath(name)
 	if _, err := os.Stat(filepath); err == nil {
 		// File already exists
 		return "", errors.New("File already exists")
 	}
-	os.MkdirAll(path.Dir(filepath), 0755)
-	f, err := os.Create(filepath)
-	if err != nil {
+	// The object metadata is written first, so that an object is never
+	// visible without it
+	if err := writeMeta(filepath, m); err != nil {
+		discardObject(filepath)
 		return "", err
 	}
 	content := strings.Join(chunkList, "\n")
-	_, err = io.WriteString(f, content)
-	if err != nil {
-		return "", err
-	}
-	err = f.Sync()
-	if err != nil {
-		return "", err
-	}
-	err = f.Close()
-	if err != nil {
+	if err := writeFileAtomic(ds.root, filepath, []byte(content), modTime); err != nil {
+		discardObject(filepath)
 		return "", err
 	}
+	ds.unpinChunks(pinned, nil)
+	pinned = nil
 
 	// Build path to be returned to the client.
 	// There are 4 args at this point:
@@ -134,7 +246,7 @@ loop:
 	random2 := path.Base(path.Dir(dir))
 	newpath = path.Join(random2+randomrest, filename)
 
-	return newpath, os.Chtimes(filepath, modTime, modTime)
+	return newpath, nil
 }
 
 type chunk struct {
@@ -144,9 +256,10 @@ type chunk struct {
 
 // doRoll chunks content according to good ol' adler32-style rolling
 // checksum, building chunks whose boundaries depend only on the bytes
-// inside the content. doRoll is expected to be run in its own
-// goroutine; when finished, the `done` channel is closed
-func doRoll(rd io.Reader, chunks chan chunk, errors chan error, done chan struct{}) {
+// inside the content; they are on average 2^bits bytes apart. doRoll
+// is expected to be run in its own goroutine; when finished, the `done`
+// channel is closed
+func doRoll(rd io.Reader, bits uint32, chunks chan chunk, errors chan error, done chan struct{}) {
 	defer close(done)
 
 	bufr := bufio.NewReader(rd)
@@ -179,7 +292,7 @@ func doRoll(rd io.Reader, chunks chan chunk, errors chan error, done chan struct
 		}
 		contentBuf = append(contentBuf, b)
 		rs.Roll(b)
-		if rs.OnSplit() {
+		if rs.OnSplitWithBits(bits) {
 			chunks <- chunkit(contentBuf)
 			contentBuf = contentBuf[:0]
 		}
@@ -187,10 +300,10 @@ func doRoll(rd io.Reader, chunks chan chunk, errors chan error, done chan struct
 }
 
 func (ds dedupStore) Get(name string) (rd readSeekCloser, modTime time.Time, err error) {
-	if len(name) < 2 {
-		return nil, time.Now(), errors.New("Invalid name")
+	filepath, err := objectPath(ds.root, name)
+	if err != nil {
+		return nil, time.Now(), err
 	}
-	filepath := path.Join(ds.root, name[:2], name[2:])
 	chunkList, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return nil, time.Now(), err
@@ -205,6 +318,14 @@ func (ds dedupStore) Get(name string) (rd readSeekCloser, modTime time.Time, err
 	return cr, st.ModTime(), err
 }
 
+func (ds dedupStore) Meta(name string) (meta, error) {
+	filepath, err := objectPath(ds.root, name)
+	if err != nil {
+		return meta{}, err
+	}
+	return readMeta(filepath)
+}
+
 // chunkedReader allows reading and seeking inside a "file" as seen by
 // the client, reconstructing content on the fly based on the metadata
 // file.
@@ -238,7 +359,7 @@ func newChunkedReader(root string, chunks []string) (*chunkedReader, error) {
 	return cr, nil
 }
 
-func (cr chunkedReader) Read(p []byte) (n int, err error) {
+func (cr *chunkedReader) Read(p []byte) (n int, err error) {
 	// We need to find the correct chunk to read from (knowing that
 	// because there is an offset, we may start from somewhere in the
 	// middle). Once we have the chunk, we read the content; if we want to
@@ -249,7 +370,11 @@ func (cr chunkedReader) Read(p []byte) (n int, err error) {
 			return cr.chunkOffsets[i] > cr.off
 		}) - 1
 		if chunkIndex == len(cr.chunkOffsets)-1 {
-			return 0, errors.New("Invalid offset")
+			// End of the content
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
 		}
 		chunkHash := cr.chunks[chunkIndex]
 		chunk, err := ioutil.ReadFile(path.Join(cr.root, chunkHash[:2], chunkHash[2:]))
@@ -266,37 +391,69 @@ func (cr chunkedReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
-func (cr chunkedReader) Seek(offset int64, whence int) (int64, error) {
+func (cr *chunkedReader) Seek(offset int64, whence int) (int64, error) {
+	off := cr.off
 	switch whence {
 	case io.SeekStart:
-		cr.off = offset
+		off = offset
 	case io.SeekCurrent:
-		cr.off += offset
+		off += offset
 	case io.SeekEnd:
 		totalSize := cr.chunkOffsets[len(cr.chunkOffsets)-1]
-		cr.off = totalSize - offset
+		off = totalSize + offset
+	}
+	if off < 0 {
+		return cr.off, errors.New("Invalid offset")
 	}
+	cr.off = off
 	return cr.off, nil
 }
 
-func (cr chunkedReader) Close() error {
+func (cr *chunkedReader) Close() error {
 	return nil
 }
 
+func (ds dedupStore) SetMeta(name string, m meta) error {
+	filepath, err := objectPath(ds.root, name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath); err != nil {
+		return err
+	}
+	return writeMeta(filepath, m)
+}
+
+func (ds dedupStore) Walk(fn func(name string, m meta) error) error {
+	return walkObjects(ds.root, func(name, filepath string) error {
+		m, err := readMeta(filepath)
+		if os.IsNotExist(err) {
+			// deleted in the meantime
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(name, m)
+	})
+}
+
 // Delete deletes the metadata file but doesn't delete chunks, since
-// they may be used somewhere else
-//
-// TODO: gc chunks. This will need some more thinking to not be too
-// inefficient, probably some kind of inverted index: map of chunk hash
-// to number of metadata files using it, each POST increases the
-// relevant chunk hashes, each DELETE decreases the relevant chunk
-// hashes, when count is 0 it is safe to delete the chunk
+// they may be used somewhere else; Collect takes care of that, on the
+// next run of the reaper.
 func (ds dedupStore) Delete(name string) error {
-	filepath := path.Join(ds.root, name[:2], name[2:])
-	err := os.Remove(filepath)
+	filepath, err := objectPath(ds.root, name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath)
 	if err != nil {
 		return err
 	}
+	requestCollect()
+	if err := removeMeta(filepath); err != nil {
+		return err
+	}
 
 	untilRandomRest := path.Dir(filepath)
 	err = os.Remove(untilRandomRest)
@@ -318,3 +475,104 @@ func (ds dedupStore) Delete(name string) error {
 	}
 	return nil
 }
+
+// Collect removes the chunks that are not used by any object anymore,
+// and returns the number of bytes freed.
+//
+// This is a plain mark and sweep: all metadata files are read to know
+// which chunks are used, then all chunks that weren't seen and aren't
+// pinned by an upload are removed. Uploads can't finish in the
+// meantime, so it is meant to be run from time to time rather than
+// after each Delete. Keeping a count of references for each chunk
+// would avoid the full scan, but that count would have to be kept
+// right across crashes.
+func (ds dedupStore) Collect() (freed int64, err error) {
+	start := time.Now()
+	freed, err = ds.collect()
+	metrics.gc(start, freed, err)
+	return freed, err
+}
+
+func (ds dedupStore) collect() (freed int64, err error) {
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+
+	used := make(map[string]bool)
+	err = walkObjects(ds.root, func(name, filepath string) error {
+		chunkList, err := ioutil.ReadFile(filepath)
+		if err != nil {
+			return err
+		}
+		for _, hash := range strings.Split(string(chunkList), "\n") {
+			used[hash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = ds.walkChunks(func(hash string, info os.FileInfo) error {
+		if used[hash] {
+			return nil
+		}
+		// Checking the pins and removing the chunk are done at once, so
+		// that an upload either sees it removed or keeps it
+		chunkPins.Lock()
+		defer chunkPins.Unlock()
+		if chunkPins.pins[hash] != nil {
+			return nil
+		}
+		if err := os.Remove(path.Join(ds.root, hash[:2], hash[2:])); err != nil {
+			return err
+		}
+		freed += info.Size()
+		return nil
+	})
+	return freed, err
+}
+
+// chunkBytes returns the size of all the chunks stored
+func (ds dedupStore) chunkBytes() (size int64, err error) {
+	err = ds.walkChunks(func(hash string, info os.FileInfo) error {
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// walkChunks calls fn for each chunk stored, stopping at the first
+// error
+func (ds dedupStore) walkChunks(fn func(hash string, info os.FileInfo) error) error {
+	fanouts, err := ioutil.ReadDir(ds.root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fanout := range fanouts {
+		if !fanout.IsDir() || len(fanout.Name()) != 2 {
+			continue
+		}
+		entries, err := ioutil.ReadDir(path.Join(ds.root, fanout.Name()))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			// Chunks are the regular files named after the rest of their
+			// hash; anything else is an object directory or metadata
+			hash := fanout.Name() + entry.Name()
+			if entry.IsDir() || len(hash) != 2*sha256.Size {
+				continue
+			}
+			if _, err := hex.DecodeString(hash); err != nil {
+				continue
+			}
+			if err := fn(hash, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// deleteTokenHeader is the header in which the delete token is sent
+// back on upload, and expected on DELETE
+const deleteTokenHeader = "X-Delete-Token"
+
+// postResult is what is sent back to the client for each stored file:
+// where to find it, and the secret needed to delete it. Knowing the
+// location is enough to read a file, but not to delete it, so links can
+// be shared safely.
+type postResult struct {
+	Location    string `json:"location"`
+	DeleteToken string `json:"deleteToken"`
+}
+
+// post stores the content under the given name with the given
+// metadata, along with a new delete token
+func (h handler) post(name string, rd io.Reader, m meta) (postResult, error) {
+	var random [32]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return postResult{}, err
+	}
+	token := hex.EncodeToString(random[:])
+	m.DeleteTokenHash = hashDeleteToken(token)
+	newpath, err := h.postWithQuota(name, rd, time.Now(), m)
+	if err != nil {
+		return postResult{}, err
+	}
+	return postResult{Location: "/?name=" + newpath, DeleteToken: token}, nil
+}
+
+// writePostResult sends the result of a single upload
+func writePostResult(w http.ResponseWriter, res postResult) {
+	w.Header().Set("Location", res.Location)
+	w.Header().Set(deleteTokenHeader, res.DeleteToken)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+func hashDeleteToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// canDelete tells whether the request is allowed to delete an object
+// with the given metadata. Admins can delete anything, and objects
+// with an owner can only be deleted by their owner. Otherwise the
+// request must carry the object's delete token; objects stored before
+// delete tokens existed can be deleted by anyone, as before.
+func canDelete(r *http.Request, m meta) bool {
+	p, authenticated := principalFrom(r)
+	if authenticated && p.scopes.allows(scopeAdmin) {
+		return true
+	}
+	if m.Owner != "" {
+		return authenticated && p.name == m.Owner
+	}
+	if m.DeleteTokenHash == "" {
+		return true
+	}
+	hash := hashDeleteToken(r.Header.Get(deleteTokenHeader))
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(m.DeleteTokenHash)) == 1
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+)
+
+var errDiskFull = errors.New("Not enough disk space")
+
+// diskCheckInterval is how many bytes of an upload are read between two
+// checks of the free space
+const diskCheckInterval = 1 << 20
+
+// diskGuard refuses uploads that would make the free space on the
+// filesystem of the store go under a reserve, so that the disk never
+// gets full: writes failing halfway would leave the server unable to
+// do anything, including cleaning up.
+type diskGuard struct {
+	root    string
+	reserve int64
+
+	// free measures the free space of a directory; it is freeSpace,
+	// except in tests
+	free func(dir string) (int64, error)
+}
+
+func newDiskGuard(root string, reserve int64) *diskGuard {
+	return &diskGuard{root: root, reserve: reserve, free: freeSpace}
+}
+
+// check tells whether an upload of the given length, or of an unknown
+// one if negative, can start
+func (dg *diskGuard) check(length int64) error {
+	free, err := dg.free(dg.root)
+	if err != nil {
+		return err
+	}
+	if length < 0 {
+		length = 0
+	}
+	if free-dg.reserve <= length {
+		return errDiskFull
+	}
+	return nil
+}
+
+// reader returns rc failing with errDiskFull as soon as the free space
+// goes under the reserve while it is read. It covers uploads of unknown
+// length and those running at the same time.
+func (dg *diskGuard) reader(rc io.ReadCloser) io.ReadCloser {
+	return &diskReader{ReadCloser: rc, dg: dg}
+}
+
+type diskReader struct {
+	io.ReadCloser
+	dg *diskGuard
+
+	// unchecked is how many bytes have been read since the last check
+	unchecked int64
+}
+
+func (dr *diskReader) Read(p []byte) (int, error) {
+	if dr.unchecked >= diskCheckInterval {
+		dr.unchecked = 0
+		if err := dr.dg.check(0); err == errDiskFull {
+			return 0, err
+		} else if err != nil {
+			log.Println("Couldn't check disk space:", err)
+		}
+	}
+	n, err := dr.ReadCloser.Read(p)
+	dr.unchecked += int64(n)
+	return n, err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// fakeDisk is a filesystem whose free space goes down by used for each
+// time it is measured
+type fakeDisk struct {
+	mu         sync.Mutex
+	free, used int64
+}
+
+func (fd *fakeDisk) freeSpace(string) (int64, error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	free := fd.free
+	fd.free -= fd.used
+	return free, nil
+}
+
+func TestDiskReserve(t *testing.T) {
+	content := make([]byte, 5<<20)
+	withStores(t, func(t *testing.T, st store, root string) {
+		disk := &fakeDisk{}
+		dg := &diskGuard{root: root, reserve: 1 << 20, free: disk.freeSpace}
+		ts := httptest.NewServer(handler{st: st, disk: dg})
+		defer ts.Close()
+
+		post := func(chunked bool) int {
+			var body io.Reader = bytes.NewReader(content)
+			if chunked {
+				body = ioutil.NopCloser(body)
+			}
+			req, _ := http.NewRequest("POST", ts.URL+"/?name=big.bin", body)
+			req.Header.Set("Content-Type", "application/octet-stream")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			return res.StatusCode
+		}
+
+		// The announced length doesn't fit above the reserve
+		disk.free = 6 << 20
+		if status := post(false); status != http.StatusInsufficientStorage {
+			t.Fatalf("got status %d, expected %d", status, http.StatusInsufficientStorage)
+		}
+		disk.free = 7 << 20
+		if status := post(false); status != http.StatusCreated {
+			t.Fatalf("got status %d with enough space, expected %d", status, http.StatusCreated)
+		}
+		before := storedFiles(t, root)
+
+		// Space runs out while a chunked upload is written: it is
+		// stopped, and leaves nothing behind
+		disk.free, disk.used = 4<<20, 1<<20
+		if status := post(true); status != http.StatusInsufficientStorage {
+			t.Fatalf("got status %d, expected %d", status, http.StatusInsufficientStorage)
+		}
+		if files := storedFiles(t, root); len(files) != len(before) {
+			t.Fatalf("got %v after running out of space, expected %v", files, before)
+		}
+
+		// Nothing is accepted under the reserve
+		disk.free, disk.used = 1<<20, 0
+		if status := post(true); status != http.StatusInsufficientStorage {
+			t.Fatalf("got status %d under the reserve, expected %d", status, http.StatusInsufficientStorage)
+		}
+	})
+}
+
+func TestDiskFullStatus(t *testing.T) {
+	err := &os.PathError{Op: "write", Path: "data/tmp/123", Err: syscall.ENOSPC}
+	if status := bodyStatus(err); status != http.StatusInsufficientStorage {
+		t.Fatalf("got status %d for %v, expected %d", status, err, http.StatusInsufficientStorage)
+	}
+}
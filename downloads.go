@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// downloadLimiter enforces the maximum number of downloads of objects
+// that have one. The number of completed downloads is persisted in the
+// object's metadata; downloads in progress are only counted in memory,
+// so that a download that fails doesn't use up one of the allowed ones,
+// while concurrent downloads can never exceed the limit.
+//
+// All operations are done under a single lock: downloads of limited
+// objects are expected to be rare, and they are mostly spent sending
+// content, outside of the lock.
+type downloadLimiter struct {
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+var downloads = &downloadLimiter{inflight: make(map[string]int)}
+
+var errNoDownloadsLeft = errors.New("No downloads left")
+
+// start reserves a download of the named object, failing if completed
+// and in-progress downloads already reach its limit
+func (dl *downloadLimiter) start(st store, name string) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	m, err := st.Meta(name)
+	if err != nil {
+		return err
+	}
+	if m.Downloads+dl.inflight[name] >= m.MaxDownloads {
+		return errNoDownloadsLeft
+	}
+	dl.inflight[name]++
+	return nil
+}
+
+// finish releases a download reserved with start. If the download
+// completed it is counted, and the object is deleted when it was the
+// last one allowed.
+func (dl *downloadLimiter) finish(st store, name string, completed bool) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.inflight[name]--
+	if dl.inflight[name] == 0 {
+		delete(dl.inflight, name)
+	}
+	if !completed {
+		return nil
+	}
+	m, err := st.Meta(name)
+	if err != nil {
+		return err
+	}
+	m.Downloads++
+	if m.Downloads < m.MaxDownloads {
+		return st.SetMeta(name, m)
+	}
+	// The chunks of a dedupStore are collected on the next run of the
+	// reaper, not while holding the lock of all downloads
+	return st.Delete(name)
+}
+
+// maxDownloadsFrom returns the maximum number of downloads given in the
+// maxDownloads parameter, 0 meaning no limit. Like for expiry, it is
+// read from the URL only.
+func maxDownloadsFrom(r *http.Request) (int, error) {
+	param := r.URL.Query().Get("maxDownloads")
+	if param == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(param)
+	if err != nil || n < 1 {
+		return 0, errors.New("Invalid maxDownloads")
+	}
+	return n, nil
+}
+
+// countingWriter is a http.ResponseWriter that remembers the status
+// code and the number of bytes of content successfully written
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	err     error
+}
+
+func (cw *countingWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func postWithQuery(t *testing.T, targetUrl, rawQuery, content string) *http.Response {
+	req, _ := http.NewRequest("POST", targetUrl+"/?"+rawQuery, strings.NewReader(content))
+	req.Header.Set("Content-Type", "text/plain")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("[POST] got status %d, expected %d", res.StatusCode, http.StatusCreated)
+	}
+	return res
+}
+
+func TestBurnAfterRead(t *testing.T) {
+	st := newDummyStore()
+	ts := httptest.NewServer(handler{st: st})
+	defer ts.Close()
+
+	res := postWithQuery(t, ts.URL, "name=secret.txt&maxDownloads=1", "a secret")
+	target := ts.URL + res.Header.Get("Location")
+	location, _ := url.Parse(res.Header.Get("Location"))
+	name := location.Query().Get("name")
+
+	// Neither HEAD nor conditional requests count as downloads
+	headRes := doRequest(t, "HEAD", target, nil)
+	if headRes.StatusCode != http.StatusOK {
+		t.Fatalf("[HEAD] got status %d, expected %d", headRes.StatusCode, http.StatusOK)
+	}
+	req, _ := http.NewRequest("GET", target, nil)
+	req.Header.Set("If-Modified-Since", headRes.Header.Get("Last-Modified"))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("[GET If-Modified-Since] got status %d, expected %d", res.StatusCode, http.StatusNotModified)
+	}
+	if st.files[name].meta.Downloads != 0 {
+		t.Fatalf("got %d downloads counted, expected 0", st.files[name].meta.Downloads)
+	}
+
+	// Ranges are ignored, the whole content is sent and counted
+	req, _ = http.NewRequest("GET", target, nil)
+	req.Header.Set("Range", "bytes=0-1")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "a secret" {
+		t.Fatalf("[GET] got status %d and body %q, expected %d and the whole content", res.StatusCode, body, http.StatusOK)
+	}
+
+	if _, ok := st.files[name]; ok {
+		t.Fatal("file still exists after its last download")
+	}
+	if res := doRequest(t, "GET", target, nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("[GET] got status %d after last download, expected %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestConcurrentDownloads(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-downloads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ts := httptest.NewServer(handler{st: fsStore{tmp}})
+	defer ts.Close()
+
+	const maxDownloads = 3
+	res := postWithQuery(t, ts.URL, "name=shared.txt&maxDownloads=3", "shared content")
+	target := ts.URL + res.Header.Get("Location")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.Get(target)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			mu.Lock()
+			statuses[res.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if statuses[http.StatusOK] != maxDownloads {
+		t.Fatalf("got %d successful downloads, expected %d (statuses: %v)", statuses[http.StatusOK], maxDownloads, statuses)
+	}
+	if statuses[http.StatusOK]+statuses[http.StatusNotFound] != 20 {
+		t.Fatalf("got unexpected statuses: %v", statuses)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// expiresHeader is the header in which clients can give the time after
+// which an upload should be deleted, as an HTTP date
+const expiresHeader = "X-Httpfile-Expires"
+
+// reapInterval is how often expired objects are looked for
+const reapInterval = time.Minute
+
+// collector is implemented by stores that don't reclaim all the space
+// used by an object when it is deleted, such as dedupStore with the
+// chunks it shares between objects
+type collector interface {
+	Collect() (freed int64, err error)
+}
+
+// collectPending is set when objects were deleted since the last
+// collection
+var collectPending int32
+
+// requestCollect asks the reaper to collect on its next run. Stores
+// call it when an object is deleted, instead of collecting right away:
+// Collect scans the whole store, and uploads can't finish meanwhile.
+func requestCollect() {
+	atomic.StoreInt32(&collectPending, 1)
+}
+
+// expiryFrom returns when the upload in the request should expire: it
+// is either given as an absolute time in the X-Httpfile-Expires header,
+// or as a duration (eg "2h30m") in the ttl parameter. The zero time
+// means the upload never expires.
+//
+// The parameter is read from the URL only, since for some uploads the
+// body is not a form.
+func expiryFrom(r *http.Request, now time.Time) (time.Time, error) {
+	header := r.Header.Get(expiresHeader)
+	ttl := r.URL.Query().Get("ttl")
+	switch {
+	case header != "" && ttl != "":
+		return time.Time{}, errors.New("Only one of " + expiresHeader + " and ttl can be given")
+	case header != "":
+		expires, err := http.ParseTime(header)
+		if err != nil {
+			return time.Time{}, errors.New("Invalid " + expiresHeader + " header")
+		}
+		if !expires.After(now) {
+			return time.Time{}, errors.New(expiresHeader + " is in the past")
+		}
+		return expires, nil
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return time.Time{}, errors.New("Invalid ttl")
+		}
+		return now.Add(d), nil
+	}
+	return time.Time{}, nil
+}
+
+// reapExpired deletes all objects that have expired at the given time,
+// then lets the store reclaim space if objects were deleted since its
+// last run, by it or anyone else. It returns the number of deleted
+// objects.
+func reapExpired(st store, now time.Time) (int, error) {
+	var expired []string
+	err := st.Walk(func(name string, m meta) error {
+		if m.expired(now) {
+			expired = append(expired, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, name := range expired {
+		if err := st.Delete(name); err != nil {
+			log.Printf("Couldn't delete expired %s: %v", name, err)
+			continue
+		}
+		deleted++
+	}
+	pending := atomic.SwapInt32(&collectPending, 0) == 1
+	if c, ok := underlying(st).(collector); ok && (deleted > 0 || pending) {
+		if _, err := c.Collect(); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// runReaper deletes expired objects and the multi-part upload sessions
+// older than uploadExpiry (if not 0) every interval, forever. It is
+// meant to be run in its own goroutine.
+func runReaper(st store, us uploadSessions, uploadExpiry, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		n, err := reapExpired(st, now)
+		if err != nil {
+			log.Println("Error reaping expired files:", err)
+		}
+		if n > 0 {
+			log.Printf("Deleted %d expired file(s)", n)
+		}
+		if uploadExpiry == 0 {
+			continue
+		}
+		n, err = us.expire(now.Add(-uploadExpiry))
+		if err != nil {
+			log.Println("Error removing stale upload sessions:", err)
+		}
+		if n > 0 {
+			log.Printf("Removed %d stale upload session(s)", n)
+		}
+	}
+}
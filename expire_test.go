@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiryFrom(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		header, ttl string
+		expected    time.Time
+		valid       bool
+	}{
+		{"", "", time.Time{}, true},
+		{"", "90m", now.Add(90 * time.Minute), true},
+		{now.Add(time.Hour).UTC().Format(http.TimeFormat), "", now.Add(time.Hour).Truncate(time.Second), true},
+		{"", "-1h", time.Time{}, false},
+		{"", "forever", time.Time{}, false},
+		{now.Add(-time.Hour).UTC().Format(http.TimeFormat), "", time.Time{}, false},
+		{now.Add(time.Hour).UTC().Format(http.TimeFormat), "1h", time.Time{}, false},
+	} {
+		r, _ := http.NewRequest("POST", "/?name=file&ttl="+url.QueryEscape(tc.ttl), nil)
+		if tc.header != "" {
+			r.Header.Set(expiresHeader, tc.header)
+		}
+		expires, err := expiryFrom(r, now)
+		if tc.valid != (err == nil) {
+			t.Errorf("[%q, %q] got error %v, expected valid=%v", tc.header, tc.ttl, err, tc.valid)
+			continue
+		}
+		if tc.valid && !expires.Equal(tc.expected) {
+			t.Errorf("[%q, %q] got %v, expected %v", tc.header, tc.ttl, expires, tc.expected)
+		}
+	}
+}
+
+func TestHandleGetExpired(t *testing.T) {
+	st := newDummyStore()
+	ts := httptest.NewServer(handler{st: st})
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/?name=content.txt&ttl=1h", strings.NewReader("content"))
+	req.Header.Set("Content-Type", "text/plain")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("[POST] got status %d, expected %d", res.StatusCode, http.StatusCreated)
+	}
+	location, _ := url.Parse(res.Header.Get("Location"))
+	name := location.Query().Get("name")
+	if expires := st.files[name].meta.Expires; expires.Before(time.Now().Add(59 * time.Minute)) {
+		t.Fatalf("got expiry %v, expected in one hour", expires)
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		if res := doRequest(t, method, ts.URL+res.Header.Get("Location"), nil); res.StatusCode != http.StatusOK {
+			t.Fatalf("[%s] got status %d before expiry, expected %d", method, res.StatusCode, http.StatusOK)
+		}
+	}
+
+	f := st.files[name]
+	f.meta.Expires = time.Now().Add(-time.Second)
+	st.files[name] = f
+	for _, method := range []string{"GET", "HEAD"} {
+		if res := doRequest(t, method, ts.URL+res.Header.Get("Location"), nil); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("[%s] got status %d after expiry, expected %d", method, res.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-reap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ds := dedupStore{root: tmp}
+
+	// Two objects sharing most of their content, one of them expiring
+	shared := make([]byte, 100000)
+	rand.New(rand.NewSource(7)).Read(shared)
+	now := time.Now()
+	kept, err := ds.Post("kept", bytes.NewReader(shared), now, meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, err := ds.Post("expiring", bytes.NewReader(append(shared, []byte("and a different end")...)), now, meta{Expires: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countChunks := func() int {
+		n := 0
+		fanouts, _ := ioutil.ReadDir(tmp)
+		for _, fanout := range fanouts {
+			entries, _ := ioutil.ReadDir(path.Join(tmp, fanout.Name()))
+			for _, e := range entries {
+				if !e.IsDir() && !strings.HasSuffix(e.Name(), ".meta") {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	before := countChunks()
+
+	if n, err := reapExpired(ds, now); err != nil || n != 0 {
+		t.Fatalf("got %d reaped (err=%v) before expiry, expected 0", n, err)
+	}
+	n, err := reapExpired(ds, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %d reaped, expected 1", n)
+	}
+	if _, err := ds.Meta(expiring); err == nil {
+		t.Fatal("expired object still exists")
+	}
+
+	// Only the last chunk was specific to the expired object
+	after := countChunks()
+	if after != before-1 {
+		t.Fatalf("got %d chunks after reaping, expected %d", after, before-1)
+	}
+	rd, _, err := ds.Get(kept)
+	if err != nil {
+		t.Fatal("kept object is not readable anymore:", err)
+	}
+	rd.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isFormUpload tells whether the request is a POST coming from an HTML
+// form with enctype="multipart/form-data"
+func isFormUpload(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "multipart/form-data"
+}
+
+// handleFormPost stores every file part of a multipart/form-data body,
+// each under the filename given by the browser. Parts are streamed to
+// the store one after the other, so nothing is buffered in memory or
+// on disk besides what the store itself does. Form fields that are not
+// files are ignored.
+//
+// The response is a 201 with a JSON list of the Locations and delete
+// tokens of all stored files, in the order they appeared in the form;
+// the Location and delete token headers are also set when there is a
+// single file.
+func (h handler) handleFormPost(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	m, err := uploadMeta(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.limitBody(w, r) {
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// If a part fails, the client never gets the locations and delete
+	// tokens of the files stored before it, so they are deleted before
+	// answering
+	results := make([]postResult, 0)
+	discard := func() {
+		for _, res := range results {
+			if err := h.st.Delete(strings.TrimPrefix(res.Location, "/?name=")); err != nil {
+				logError(r, "Couldn't delete file of failed form upload:", err)
+			}
+		}
+	}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			discard()
+			if !bodyError(w, err) {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+			}
+			return
+		}
+		if p.FormName() == "" || p.FileName() == "" {
+			p.Close()
+			continue
+		}
+		res, err := h.post(p.FileName(), p, m)
+		p.Close()
+		if err != nil {
+			discard()
+			postError(w, r, err)
+			return
+		}
+		results = append(results, res)
+	}
+	if len(results) == 0 {
+		http.Error(w, "No file in form", http.StatusBadRequest)
+		return
+	}
+
+	if len(results) == 1 {
+		w.Header().Set("Location", results[0].Location)
+		w.Header().Set(deleteTokenHeader, results[0].DeleteToken)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHandleFormPost(t *testing.T) {
+	st := newDummyStore()
+	ts := httptest.NewServer(handler{st: st})
+	defer ts.Close()
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"first.txt", "This is the first file"},
+		{"second.txt", "This is the second file"},
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("comment", "not a file")
+	for _, f := range files {
+		fw, err := mw.CreateFormFile("file", f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f.content))
+	}
+	mw.Close()
+
+	res, err := http.Post(ts.URL+"/", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d, expected %d", res.StatusCode, http.StatusCreated)
+	}
+	if res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("got Content-Type %s, expected application/json", res.Header.Get("Content-Type"))
+	}
+
+	var results []postResult
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatal("Couldn't decode body:", err)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("got %d results, expected %d", len(results), len(files))
+	}
+	for i, result := range results {
+		location := result.Location
+		u, err := url.Parse(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, ok := st.files[u.Query().Get("name")]
+		if !ok {
+			t.Fatalf("file %s not found in store", location)
+		}
+		if string(f.content) != files[i].content {
+			t.Fatalf("got content %q for %s, expected %q", f.content, location, files[i].content)
+		}
+		if f.meta.DeleteTokenHash != hashDeleteToken(result.DeleteToken) {
+			t.Fatalf("delete token for %s doesn't match the stored one", location)
+		}
+	}
+
+	// A form without any file is rejected
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	mw.WriteField("comment", "not a file")
+	mw.Close()
+	res, err = http.Post(ts.URL+"/", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d for form without file, expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestHandleFormPostFailure(t *testing.T) {
+	st := newDummyStore()
+	u, _ := newUsage(st)
+	ts := httptest.NewServer(handler{
+		st:     accountingStore{st, u},
+		usage:  u,
+		quotas: &quotas{def: quotaLimit{Logical: 10}},
+	})
+	defer ts.Close()
+
+	// The second file goes over the quota, after the first one was
+	// stored
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, content := range []string{"five.", "twenty bytes or so.."} {
+		fw, err := mw.CreateFormFile("file", "file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
+
+	res, err := http.Post(ts.URL+"/", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, expected %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	if len(st.files) != 0 {
+		t.Fatalf("got %d files left in the store, expected none", len(st.files))
+	}
+	if used := u.get(""); used.Files != 0 || used.Logical != 0 {
+		t.Fatalf("got usage %+v, expected nothing", used)
+	}
+}
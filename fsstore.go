@@ -31,27 +31,39 @@ func (fs fsStore) randomPath(name string) string {
 	return path.Join(fs.root, randomString[:2], randomString[2:], filename)
 }
 
-func (fs fsStore) Post(name string, rd io.Reader, modTime time.Time) (newpath string, err error) {
+func (fs fsStore) Post(name string, rd io.Reader, modTime time.Time, m meta) (newpath string, err error) {
 	filepath := fs.randomPath(name)
 	if _, err := os.Stat(filepath); err == nil {
 		// File already exists
 		return "", errors.New("File already exists")
 	}
-	os.MkdirAll(path.Dir(filepath), 0700)
-	f, err := os.Create(filepath)
+	// The content is written to a temporary file and only renamed to
+	// its final path once complete, so that a truncated file is never
+	// served, even after a crash
+	f, err := tempFile(fs.root)
 	if err != nil {
 		return "", err
 	}
-	_, err = io.Copy(f, rd)
+	size, err := io.Copy(f, rd)
+	if err == nil {
+		err = faultHook("written")
+	}
 	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return "", err
 	}
-	err = f.Sync()
-	if err != nil {
+	// Nothing is shared between files, all bytes are new. The metadata
+	// is written first, so that an object is never visible without it.
+	m.Size, m.NewBytes = size, size
+	if err := writeMeta(filepath, m); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		discardObject(filepath)
 		return "", err
 	}
-	err = f.Close()
-	if err != nil {
+	if err := commitFile(fs.root, f, filepath, modTime); err != nil {
+		discardObject(filepath)
 		return "", err
 	}
 
@@ -70,17 +82,17 @@ func (fs fsStore) Post(name string, rd io.Reader, modTime time.Time) (newpath st
 	random2 := path.Base(path.Dir(dir))
 	newpath = path.Join(random2+randomrest, filename)
 
-	return newpath, os.Chtimes(filepath, modTime, modTime)
+	return newpath, nil
 }
 
 // Note: it's easy to exhaust the server's resources here because each
 // file is kept open as long as it's not completely served. Don't use
 // this with high volume !
 func (fs fsStore) Get(name string) (rd readSeekCloser, modTime time.Time, err error) {
-	if len(name) < 2 {
-		return nil, time.Now(), errors.New("Invalid name")
+	path, err := objectPath(fs.root, name)
+	if err != nil {
+		return nil, time.Now(), err
 	}
-	path := path.Join(fs.root, name[:2], name[2:])
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, time.Now(), err
@@ -92,12 +104,51 @@ func (fs fsStore) Get(name string) (rd readSeekCloser, modTime time.Time, err er
 	return f, st.ModTime(), nil
 }
 
+func (fs fsStore) Meta(name string) (meta, error) {
+	filepath, err := objectPath(fs.root, name)
+	if err != nil {
+		return meta{}, err
+	}
+	return readMeta(filepath)
+}
+
+func (fs fsStore) SetMeta(name string, m meta) error {
+	filepath, err := objectPath(fs.root, name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath); err != nil {
+		return err
+	}
+	return writeMeta(filepath, m)
+}
+
+func (fs fsStore) Walk(fn func(name string, m meta) error) error {
+	return walkObjects(fs.root, func(name, filepath string) error {
+		m, err := readMeta(filepath)
+		if os.IsNotExist(err) {
+			// deleted in the meantime
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(name, m)
+	})
+}
+
 func (fs fsStore) Delete(name string) error {
-	filepath := path.Join(fs.root, name[:2], name[2:])
-	err := os.Remove(filepath)
+	filepath, err := objectPath(fs.root, name)
 	if err != nil {
 		return err
 	}
+	err = os.Remove(filepath)
+	if err != nil {
+		return err
+	}
+	if err := removeMeta(filepath); err != nil {
+		return err
+	}
 
 	untilRandomRest := path.Dir(filepath)
 	err = os.Remove(untilRandomRest)
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -34,7 +35,7 @@ func postDefaultContent(t *testing.T, targetUrl string) (res *http.Response, con
 }
 
 func TestHandlePost(t *testing.T) {
-	h := handler{newDummyStore()}
+	h := handler{st: newDummyStore()}
 	ts := httptest.NewServer(h)
 
 	res, _, err := postDefaultContent(t, ts.URL)
@@ -53,8 +54,8 @@ func TestHandlePost(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Invalid Content-Type header(%s): %v", res.Header.Get("Content-Type"), err)
 	}
-	if mt != "text/plain" {
-		t.Fatalf("got mimetype %s, expected text/plain", mt)
+	if mt != "application/json" {
+		t.Fatalf("got mimetype %s, expected application/json", mt)
 	}
 
 	location := res.Header.Get("Location")
@@ -62,10 +63,21 @@ func TestHandlePost(t *testing.T) {
 	if location != expectedLocation {
 		t.Fatalf("Invalid location header, got %s, expected %s", location, expectedLocation)
 	}
+
+	var result postResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatal("Couldn't decode body:", err)
+	}
+	if result.Location != location {
+		t.Fatalf("got location %s in body, expected %s", result.Location, location)
+	}
+	if result.DeleteToken == "" || result.DeleteToken != res.Header.Get(deleteTokenHeader) {
+		t.Fatalf("got delete token %q in body and %q in header, expected the same non-empty token", result.DeleteToken, res.Header.Get(deleteTokenHeader))
+	}
 }
 
 func TestHandleGetHead(t *testing.T) {
-	h := handler{newDummyStore()}
+	h := handler{st: newDummyStore()}
 	ts := httptest.NewServer(h)
 
 	postRes, content, err := postDefaultContent(t, ts.URL)
@@ -117,7 +129,7 @@ func TestHandleGetHead(t *testing.T) {
 			t.Fatalf("[%s] got mimetype %s, expected text/plain", method, mt)
 		}
 
-		expectedEtag := "75ed184249e9bc19675e4d1f766213da71b64278fed2cad5f18a247619205e30"
+		expectedEtag := `"75ed184249e9bc19675e4d1f766213da71b64278fed2cad5f18a247619205e30"`
 		if getRes.Header.Get("Etag") != expectedEtag {
 			t.Fatalf("[%s] got Etag %s, expected %s", method, getRes.Header.Get("Etag"), expectedEtag)
 		}
@@ -136,7 +148,7 @@ func TestHandleGetHead(t *testing.T) {
 }
 
 func TestHandleDelete(t *testing.T) {
-	h := handler{newDummyStore()}
+	h := handler{st: newDummyStore()}
 	ts := httptest.NewServer(h)
 
 	postRes, _, err := postDefaultContent(t, ts.URL)
@@ -158,11 +170,25 @@ func TestHandleDelete(t *testing.T) {
 		t.Fatal("[DELETE] got status code %d, expected %d", deleteRes.StatusCode, http.StatusInternalServerError)
 	}
 
-	// then test existing file
+	// then test existing file, without and with the wrong delete token
 	targetUrl, _ = url.Parse(ts.URL)
 	location, _ := url.Parse(postRes.Header.Get("Location"))
 	targetUrl.RawQuery = location.RawQuery
+	for _, token := range []string{"", "wrong-token"} {
+		deleteReq, _ = http.NewRequest("DELETE", targetUrl.String(), nil)
+		deleteReq.Header.Set(deleteTokenHeader, token)
+		deleteRes, err = http.DefaultClient.Do(deleteReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleteRes.StatusCode != http.StatusForbidden {
+			t.Fatalf("[DELETE] got status code %d with token %q, expected %d", deleteRes.StatusCode, token, http.StatusForbidden)
+		}
+	}
+
+	// then with the right one
 	deleteReq, _ = http.NewRequest("DELETE", targetUrl.String(), nil)
+	deleteReq.Header.Set(deleteTokenHeader, postRes.Header.Get(deleteTokenHeader))
 	deleteRes, err = http.DefaultClient.Do(deleteReq)
 	if err != nil {
 		t.Fatal(err)
@@ -186,6 +212,7 @@ type file struct {
 	name    string
 	content []byte
 	modTime time.Time
+	meta    meta
 }
 
 var _ store = &dummyStore{}
@@ -202,7 +229,7 @@ func newDummyStore() *dummyStore {
 	}
 }
 
-func (ds *dummyStore) Post(name string, rd io.Reader, modTime time.Time) (newpath string, err error) {
+func (ds *dummyStore) Post(name string, rd io.Reader, modTime time.Time, m meta) (newpath string, err error) {
 	var randBytes [32]byte
 	ds.r.Read(randBytes[:])
 	fullpath := path.Join(hex.EncodeToString(randBytes[:]), name)
@@ -210,10 +237,12 @@ func (ds *dummyStore) Post(name string, rd io.Reader, modTime time.Time) (newpat
 	if err != nil {
 		return "", err
 	}
+	m.Size, m.NewBytes = int64(len(content)), int64(len(content))
 	ds.files[fullpath] = file{
 		name:    fullpath,
 		content: content,
 		modTime: modTime,
+		meta:    m,
 	}
 	return fullpath, nil
 }
@@ -226,6 +255,33 @@ func (ds *dummyStore) Get(name string) (rd readSeekCloser, modTime time.Time, er
 	return nopCloser{bytes.NewReader(f.content)}, f.modTime, nil
 }
 
+func (ds *dummyStore) Meta(name string) (meta, error) {
+	f, ok := ds.files[name]
+	if !ok {
+		return meta{}, errors.New("Not found")
+	}
+	return f.meta, nil
+}
+
+func (ds *dummyStore) SetMeta(name string, m meta) error {
+	f, ok := ds.files[name]
+	if !ok {
+		return errors.New("Not found")
+	}
+	f.meta = m
+	ds.files[name] = f
+	return nil
+}
+
+func (ds *dummyStore) Walk(fn func(name string, m meta) error) error {
+	for name, f := range ds.files {
+		if err := fn(name, f.meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type nopCloser struct {
 	io.ReadSeeker
 }
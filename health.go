@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"syscall"
+)
+
+// pinger is implemented by stores that depend on a service which can
+// be unreachable, such as remote backends. Local stores don't need it.
+type pinger interface {
+	Ping() error
+}
+
+// readiness tells whether the store under root can take uploads
+type readiness struct {
+	root string
+
+	// minFree is the free space on the filesystem of root under which
+	// the server isn't ready; 0 means no minimum
+	minFree int64
+}
+
+// readyCheck is the result of one of the checks done for readiness
+type readyCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	// Free and MinFree are set by the free space check
+	Free    int64 `json:"free,omitempty"`
+	MinFree int64 `json:"minFree,omitempty"`
+}
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem holding dir. If dir doesn't exist yet, it is the
+// filesystem it will be created on.
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(dir, &fs)
+	for err == syscall.ENOENT && path.Dir(dir) != dir {
+		dir = path.Dir(dir)
+		err = syscall.Statfs(dir, &fs)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
+
+// checks runs all the checks on st, stored under the root of rd
+func (rd readiness) checks(st store) []readyCheck {
+	var checks []readyCheck
+	result := func(name string, err error) readyCheck {
+		c := readyCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		return c
+	}
+
+	checks = append(checks, result("writable", checkWritable(rd.root)))
+
+	free, err := freeSpace(rd.root)
+	if err == nil && free < rd.minFree {
+		err = fmt.Errorf("%d bytes free, less than %d", free, rd.minFree)
+	}
+	c := result("freeSpace", err)
+	c.Free, c.MinFree = free, rd.minFree
+	checks = append(checks, c)
+
+	if p, ok := underlying(st).(pinger); ok {
+		checks = append(checks, result("reachable", p.Ping()))
+	}
+	return checks
+}
+
+// checkWritable makes sure a file can be written in the store under
+// root, where uploads write theirs first
+func checkWritable(root string) error {
+	f, err := tempFile(root)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ready?")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// isHealthRequest tells whether the request is a health or readiness
+// probe. Probes need no authentication and aren't rate limited, so that
+// orchestrators can make them.
+func isHealthRequest(r *http.Request) bool {
+	return (r.Method == "GET" || r.Method == "HEAD") && (r.URL.Path == "/healthz" || r.URL.Path == "/readyz")
+}
+
+// handleHealth answers /healthz, whose only check is that the process
+// answers, and /readyz, with the result of each check as JSON and a 503
+// if any failed
+func (h handler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	res := struct {
+		Status string       `json:"status"`
+		Checks []readyCheck `json:"checks,omitempty"`
+	}{Status: "ok"}
+	status := http.StatusOK
+	if r.URL.Path == "/readyz" && h.readiness != nil {
+		res.Checks = h.readiness.checks(h.st)
+		for _, c := range res.Checks {
+			if !c.OK {
+				res.Status = "fail"
+				status = http.StatusServiceUnavailable
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
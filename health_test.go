@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// unreachableStore is a store whose backend can't be reached
+type unreachableStore struct {
+	*dummyStore
+}
+
+func (unreachableStore) Ping() error {
+	return errors.New("connection refused")
+}
+
+func TestHealth(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	notDir := path.Join(tmp, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Probes need no token
+	auth := &tokenAuth{tokens: make(map[string]principal)}
+	for _, tc := range []struct {
+		name      string
+		st        store
+		readiness readiness
+		status    int
+		failed    string
+	}{
+		{"ready", newDummyStore(), readiness{root: tmp}, http.StatusOK, ""},
+		{"not writable", newDummyStore(), readiness{root: notDir}, http.StatusServiceUnavailable, "writable"},
+		{"disk full", newDummyStore(), readiness{root: tmp, minFree: 1 << 62}, http.StatusServiceUnavailable, "freeSpace"},
+		{"unreachable", accountingStore{unreachableStore{newDummyStore()}, nil}, readiness{root: tmp}, http.StatusServiceUnavailable, "reachable"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := handler{st: tc.st, auth: auth, readiness: &tc.readiness}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d for /healthz, expected %d", rec.Code, http.StatusOK)
+			}
+
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+			var res struct {
+				Status string
+				Checks []readyCheck
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("got status %d and %+v, expected %d", rec.Code, res, tc.status)
+			}
+			for _, c := range res.Checks {
+				if c.OK == (c.Name == tc.failed) {
+					t.Errorf("got check %+v, expected only %q to fail", c, tc.failed)
+				}
+			}
+			if tc.failed == "" && (res.Status != "ok" || len(res.Checks) != 2) {
+				t.Errorf("got %+v, expected the writable and free space checks to pass", res)
+			}
+		})
+	}
+
+	// Nothing is left behind by the checks
+	if files, _ := ioutil.ReadDir(path.Join(tmp, tmpDirName)); len(files) != 0 {
+		t.Fatalf("got %d files left in the temporary directory", len(files))
+	}
+}
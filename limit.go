@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"syscall"
+)
+
+var errLengthMismatch = errors.New("Body length doesn't match Content-Length")
+
+// uploadLimit returns the maximum size of an upload body for the
+// principal making the request: their own if their token has one,
+// otherwise the server's. 0 means no limit.
+func (h handler) uploadLimit(r *http.Request) int64 {
+	if p, ok := principalFrom(r); ok && p.maxUploadSize > 0 {
+		return p.maxUploadSize
+	}
+	return h.maxUploadSize
+}
+
+// limitBody makes sure the body of an upload is no bigger than allowed
+// and exactly as long as announced, and that there is room for it on
+// disk. An upload announced as too big is refused right away with a 413
+// (or a 507 if it can't fit on disk) and false is returned; otherwise
+// the body is replaced so that reading it fails as soon as it goes over
+// the limit, doesn't match its Content-Length or the disk gets too
+// full, and the store is left with nothing from it.
+func (h handler) limitBody(w http.ResponseWriter, r *http.Request) bool {
+	limit := h.uploadLimit(r)
+	if limit > 0 && r.ContentLength > limit {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if h.disk != nil {
+		if err := h.disk.check(r.ContentLength); err == errDiskFull {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return false
+		} else if err != nil {
+			logError(r, "Couldn't check disk space:", err)
+		}
+		r.Body = h.disk.reader(r.Body)
+	}
+	if r.ContentLength >= 0 {
+		r.Body = &lengthReader{rc: r.Body, remaining: r.ContentLength}
+	}
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	return true
+}
+
+// bodyStatus returns the status code to answer an error from reading
+// a body limited by limitBody, or from having no room to write it, or
+// 0 if it isn't about the body
+func bodyStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errLengthMismatch):
+		return http.StatusBadRequest
+	case errors.Is(err, errDiskFull), errors.Is(err, syscall.ENOSPC):
+		// The disk can still get full with a reserve, if something
+		// else than uploads fills it
+		return http.StatusInsufficientStorage
+	}
+	return 0
+}
+
+// bodyError answers a request whose body couldn't be read because of
+// limitBody, telling whether err was about that
+func bodyError(w http.ResponseWriter, err error) bool {
+	switch status := bodyStatus(err); status {
+	case 0:
+		return false
+	case http.StatusInsufficientStorage:
+		http.Error(w, errDiskFull.Error(), status)
+	default:
+		http.Error(w, "Invalid body: "+err.Error(), status)
+	}
+	return true
+}
+
+// lengthReader fails with errLengthMismatch if the content it reads
+// isn't exactly remaining bytes long. net/http already stops reading at
+// Content-Length, but a client can still hang up before sending all of
+// it.
+type lengthReader struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (lr *lengthReader) Read(p []byte) (n int, err error) {
+	n, err = lr.rc.Read(p)
+	lr.remaining -= int64(n)
+	switch {
+	case lr.remaining < 0:
+		return n, errLengthMismatch
+	case err == io.EOF && lr.remaining > 0, err == io.ErrUnexpectedEOF:
+		return n, errLengthMismatch
+	}
+	return n, err
+}
+
+func (lr *lengthReader) Close() error {
+	return lr.rc.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaxUploadSize(t *testing.T) {
+	filename := writeTokens(t, "alice "+hashToken("alice-token")+" upload,read\n"+
+		"bob "+hashToken("bob-token")+" upload,read 20\n")
+	defer os.Remove(filename)
+	auth, err := loadTokens(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "httpfile-limit-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	st := newDummyStore()
+	ts := httptest.NewServer(handler{st: st, auth: auth, uploads: uploadSessions{tmp}, maxUploadSize: 10})
+	defer ts.Close()
+
+	do := func(method, target, token, content string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+target, strings.NewReader(content))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	for _, tt := range []struct {
+		token, content string
+		expected       int
+	}{
+		{"alice-token", "ten bytes.", http.StatusCreated},
+		{"alice-token", "eleven bytes", http.StatusRequestEntityTooLarge},
+		// bob's token has its own limit
+		{"bob-token", "more than ten bytes", http.StatusCreated},
+		{"bob-token", "even more than twenty bytes", http.StatusRequestEntityTooLarge},
+	} {
+		if res := do("POST", "/?name=file.txt", tt.token, tt.content); res.StatusCode != tt.expected {
+			t.Errorf("[%s, %q] got status %d, expected %d", tt.token, tt.content, res.StatusCode, tt.expected)
+		}
+	}
+	if len(st.files) != 2 {
+		t.Fatalf("got %d files stored, expected 2", len(st.files))
+	}
+
+	// Parts are limited, and so is the file they make
+	res := do("POST", "/?uploads&name=parts.txt", "alice-token", "")
+	session := res.Header.Get("Location")
+	if res := do("PUT", session+"&partNumber=1", "alice-token", "eleven bytes"); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("[PUT part] got status %d, expected %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	var parts []string
+	for i, content := range []string{"1 part", "2 part"} {
+		res := do("PUT", session+"&partNumber="+content[:1], "alice-token", content)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("[PUT part %d] got status %d, expected %d", i+1, res.StatusCode, http.StatusOK)
+		}
+		parts = append(parts, content[:1]+" "+res.Header.Get("Etag"))
+	}
+	if res := do("POST", session, "alice-token", strings.Join(parts, "\n")); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("[complete] got status %d, expected %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	withStores(t, func(t *testing.T, st store, root string) {
+		h := handler{st: st}
+		// Big enough for chunks to be written before the body ends
+		content := make([]byte, 100000)
+		rand.New(rand.NewSource(1)).Read(content)
+		req := httptest.NewRequest("POST", "/?name=file.txt", bytes.NewReader(content))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Content-Length", "200000")
+		req.ContentLength = 200000
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d, expected %d", w.Code, http.StatusBadRequest)
+		}
+
+		// Nothing is left from the upload, not even chunks
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				t.Errorf("found %s after failed upload", p)
+			}
+			return nil
+		})
+	})
+}
+
+func TestChunkedUpload(t *testing.T) {
+	st := newDummyStore()
+	ts := httptest.NewServer(handler{st: st, maxUploadSize: 20})
+	defer ts.Close()
+
+	post := func(content string) int {
+		// Wrapping the reader hides its length, so the client sends it
+		// chunked
+		req, _ := http.NewRequest("POST", ts.URL+"/?name=stream.txt", ioutil.NopCloser(strings.NewReader(content)))
+		req.Header.Set("Content-Type", "text/plain")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := post("streamed content"); status != http.StatusCreated {
+		t.Fatalf("got status %d, expected %d", status, http.StatusCreated)
+	}
+	for _, f := range st.files {
+		if string(f.content) != "streamed content" || f.meta.Size != int64(len("streamed content")) {
+			t.Fatalf("got content %q of size %d, expected the streamed content", f.content, f.meta.Size)
+		}
+	}
+	if status := post("streamed content, but too much of it"); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, expected %d", status, http.StatusRequestEntityTooLarge)
+	}
+	if len(st.files) != 1 {
+		t.Fatalf("got %d files stored, expected 1", len(st.files))
+	}
+
+	// With HTTP/2, a body of unknown length has no Content-Length and
+	// isn't chunked either
+	ts2 := httptest.NewUnstartedServer(handler{st: st})
+	ts2.EnableHTTP2 = true
+	ts2.StartTLS()
+	defer ts2.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("streamed over HTTP/2"))
+		pw.Close()
+	}()
+	req, _ := http.NewRequest("POST", ts2.URL+"/?name=stream.txt", pr)
+	req.Header.Set("Content-Type", "text/plain")
+	res, err := ts2.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.ProtoMajor != 2 || res.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d over %s, expected %d over HTTP/2", res.StatusCode, res.Proto, http.StatusCreated)
+	}
+}
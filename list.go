@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+)
+
+// listEntry describes an object in a listing
+type listEntry struct {
+	Location string    `json:"location"`
+	Name     string    `json:"name"`
+	Expires  time.Time `json:"expires,omitzero"`
+}
+
+// isListRequest tells whether the request asks for the list of the
+// principal's objects
+func isListRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["list"]
+	return r.Method == "GET" && ok
+}
+
+// handleList sends the JSON list of the objects owned by the principal
+// making the request. Admins can list the objects of someone else with
+// the owner parameter.
+//
+// Listing is only available with authentication: without it there is
+// no owner, and listing everything would hand out all the paths, which
+// are the only thing protecting files from being read.
+func (h handler) handleList(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFrom(r)
+	if !ok {
+		http.Error(w, "Listing requires authentication", http.StatusBadRequest)
+		return
+	}
+	owner := p.name
+	if other := r.URL.Query().Get("owner"); other != "" && other != owner {
+		if !p.scopes.allows(scopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		owner = other
+	}
+
+	now := time.Now()
+	entries := make([]listEntry, 0)
+	err := h.st.Walk(func(name string, m meta) error {
+		if m.Owner != owner || m.expired(now) {
+			return nil
+		}
+		entries = append(entries, listEntry{
+			Location: "/?name=" + name,
+			Name:     path.Base(name),
+			Expires:  m.Expires,
+		})
+		return nil
+	})
+	if err != nil {
+		logError(r, "Error listing:", err)
+		http.Error(w, "Error listing files", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Location < entries[j].Location
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOwnership(t *testing.T) {
+	filename := writeTokens(t, "alice "+hashToken("alice-token")+" upload,read,delete\n"+
+		"bob "+hashToken("bob-token")+" upload,read,delete\n"+
+		"admin "+hashToken("admin-token")+" admin\n")
+	defer os.Remove(filename)
+	auth, err := loadTokens(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "httpfile-owner-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	st := newDummyStore()
+	ts := httptest.NewServer(handler{st: st, auth: auth, uploads: uploadSessions{tmp}})
+	defer ts.Close()
+
+	do := func(method, target, token string, header http.Header) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+target, strings.NewReader("content"))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Authorization", "Bearer "+token)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	list := func(target, token string) []listEntry {
+		res := do("GET", target, token, nil)
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("[%s] got status %d, expected %d", target, res.StatusCode, http.StatusOK)
+		}
+		var entries []listEntry
+		if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	res := do("POST", "/?name=alice.txt", "alice-token", nil)
+	res.Body.Close()
+	location := res.Header.Get("Location")
+	deleteToken := res.Header.Get(deleteTokenHeader)
+	u, _ := url.Parse(location)
+	if owner := st.files[u.Query().Get("name")].meta.Owner; owner != "alice" {
+		t.Fatalf("got owner %q, expected alice", owner)
+	}
+
+	// Files can still be read by others, but only listed by their owner
+	if res := do("GET", location, "bob-token", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("[GET as bob] got status %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+	if entries := list("/?list", "alice-token"); len(entries) != 1 || entries[0].Location != location || entries[0].Name != "alice.txt" {
+		t.Fatalf("got list %+v for alice, expected her file", entries)
+	}
+	if entries := list("/?list", "bob-token"); len(entries) != 0 {
+		t.Fatalf("got list %+v for bob, expected nothing", entries)
+	}
+	if res := do("GET", "/?list&owner=alice", "bob-token", nil); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("[list alice's as bob] got status %d, expected %d", res.StatusCode, http.StatusForbidden)
+	}
+	if entries := list("/?list&owner=alice", "admin-token"); len(entries) != 1 {
+		t.Fatalf("got list %+v of alice's files for admin, expected 1 file", entries)
+	}
+
+	// Only the owner can delete, even with the delete token
+	header := http.Header{}
+	header.Set(deleteTokenHeader, deleteToken)
+	if res := do("DELETE", location, "bob-token", header); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("[DELETE as bob] got status %d, expected %d", res.StatusCode, http.StatusForbidden)
+	}
+	if res := do("DELETE", location, "alice-token", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("[DELETE as alice] got status %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	// Upload sessions belong to whoever initiated them
+	res = do("POST", "/?uploads&name=parts.txt", "alice-token", nil)
+	res.Body.Close()
+	session := res.Header.Get("Location")
+	if res := do("PUT", session+"&partNumber=1", "bob-token", nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("[PUT part as bob] got status %d, expected %d", res.StatusCode, http.StatusNotFound)
+	}
+	if res := do("PUT", session+"&partNumber=1", "alice-token", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("[PUT part as alice] got status %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+}
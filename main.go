@@ -1,12 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"mime"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -19,21 +27,152 @@ type readSeekCloser interface {
 // store is the interface to be implemented by backends for basic
 // operations
 type store interface {
-	Post(name string, rd io.Reader, modTime time.Time) (newpath string, err error)
+	Post(name string, rd io.Reader, modTime time.Time, m meta) (newpath string, err error)
 	Get(name string) (rd readSeekCloser, modTime time.Time, err error)
+	Meta(name string) (meta, error)
+	SetMeta(name string, m meta) error
 	Delete(name string) error
+
+	// Walk calls fn for each stored object, stopping at the first error
+	Walk(fn func(name string, m meta) error) error
 }
 
 type handler struct {
-	st store
+	st      store
+	uploads uploadSessions
+
+	// auth authenticates requests; if nil, anyone can do anything
+	auth *tokenAuth
+
+	// signer verifies signed URLs; if nil, they are refused
+	signer *urlSigner
+
+	// usage is kept up to date by st, which must then be an
+	// accountingStore; quotas are enforced if not nil
+	usage  *usage
+	quotas *quotas
+
+	// maxUploadSize is the maximum size of an upload body, unless the
+	// token has its own; 0 means no limit
+	maxUploadSize int64
+
+	// limiter limits the rate of each client; if nil, they are not
+	// limited
+	limiter *rateLimiter
+
+	// disk refuses uploads when the disk of the store is nearly full;
+	// if nil, they are always accepted
+	disk *diskGuard
+
+	// readiness checks the store for /readyz; if nil, the server is
+	// always ready
+	readiness *readiness
+
+	// accessLog gets a line for each request; if nil, requests are not
+	// logged
+	accessLog *accessLog
+
+	// retention tells which old versions of stable names are kept
+	retention retention
 }
 
 func main() {
-	http.Handle("/", handler{dedupStore{"data"}})
-	log.Println("Serving on :8080")
-	err := http.ListenAndServe(":8080", nil)
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		signCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		statsCommand(os.Args[2:])
+		return
+	}
+
+	c, printConfig, err := parseConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		log.Println(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(c)
+		return
+	}
+	if c.LogFile != "" {
+		f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal("Couldn't open log file: ", err)
+		}
+		log.SetOutput(f)
+	}
+
+	h, err := c.newHandler()
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := sweepStale(h.st, c.Root, c.Uploads)
+	if err != nil {
+		log.Fatal("Couldn't clean up interrupted uploads: ", err)
+	}
+	if n > 0 {
+		log.Printf("Removed %d file(s) left by interrupted uploads", n)
+	}
+	go runReaper(h.st, h.uploads, c.uploadExpiry(), reapInterval)
+	go runPruner(h.st, h.retention, reapInterval)
+	if h.accessLog != nil {
+		go h.accessLog.watch()
+	}
+	dh := newDrainingHandler(h)
+
+	var tlsConfig *tls.Config
+	if c.TLSCert != "" {
+		cr, err := newCertReloader(c.TLSCert, c.TLSKey)
+		if err != nil {
+			log.Fatal("Couldn't load certificate: ", err)
+		}
+		go cr.watch()
+		if tlsConfig, err = newTLSConfig(cr, c.TLSClientCA); err != nil {
+			log.Fatal("Couldn't load client CAs: ", err)
+		}
+	}
+
+	var servers []*http.Server
+	for _, addr := range c.Listen {
+		servers = append(servers, &http.Server{Addr: addr, Handler: dh, TLSConfig: tlsConfig})
+	}
+	if c.RedirectHTTP != "" {
+		// Redirections go to the first address
+		_, port, _ := net.SplitHostPort(c.Listen[0])
+		servers = append(servers, &http.Server{Addr: c.RedirectHTTP, Handler: redirectHandler{port}})
+	}
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			switch {
+			case srv.Handler != dh:
+				log.Println("Redirecting to HTTPS on", srv.Addr)
+				errs <- srv.ListenAndServe()
+			case tlsConfig != nil:
+				log.Println("Serving HTTPS on", srv.Addr)
+				errs <- srv.ListenAndServeTLS("", "")
+			default:
+				log.Println("Serving on", srv.Addr)
+				errs <- srv.ListenAndServe()
+			}
+		}(srv)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case sig := <-sigs:
+		log.Printf("Got %s, shutting down", sig)
+		shutdown(servers, dh, c.shutdownTimeout())
+		log.Println("Shut down")
 	}
 }
 
@@ -43,13 +182,89 @@ func main() {
 // never sent to the client; they have no business knowing how the
 // server works.
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r = withRequestID(r)
+	w.Header().Set(requestIDHeader, requestIDFrom(r))
+	cw := &countingWriter{ResponseWriter: w}
+	cr := &countingReader{ReadCloser: r.Body}
+	w = cw
+	if r.Body != nil {
+		r.Body = cr
+	}
+	defer func() {
+		metrics.request(r.Method, cw.status, time.Since(start), cr.read, cw.written)
+		if h.accessLog != nil {
+			h.accessLog.write(newAccessEntry(r, start, cw.status, cr.read, cw.written))
+		}
+	}()
+
+	if isHealthRequest(r) {
+		h.handleHealth(w, r)
+		return
+	}
+	if isUIRequest(r) {
+		h.handleUI(w, r)
+		return
+	}
+	if !h.limitAddress(w, r) {
+		return
+	}
+	if isSignedRequest(r) {
+		if !h.checkSignature(w, r) {
+			return
+		}
+	} else if h.auth != nil {
+		var ok bool
+		if r, ok = h.authorize(w, r); !ok {
+			return
+		}
+	}
+	done, ok := h.rateLimit(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	if isMetricsRequest(r) {
+		h.handleMetrics(w, r)
+		return
+	}
+	if isSignRequest(r) {
+		h.handleSign(w, r)
+		return
+	}
+	if isListRequest(r) {
+		h.handleList(w, r)
+		return
+	}
+	if isVersionsRequest(r) {
+		h.handleVersions(w, r)
+		return
+	}
+	if isStatsRequest(r) {
+		h.handleStats(w, r)
+		return
+	}
+	if isUsageRequest(r) {
+		h.handleUsage(w, r)
+		return
+	}
+	if isUploadRequest(r) {
+		h.handleUpload(w, r)
+		return
+	}
 	if !check(r) {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 	switch r.Method {
 	case "POST":
+		if isFormUpload(r) {
+			h.handleFormPost(w, r)
+			return
+		}
 		h.handlePost(w, r)
+	case "PUT":
+		h.handlePut(w, r)
 	case "GET", "HEAD":
 		h.handleGet(w, r, r.Method)
 	case "DELETE":
@@ -60,13 +275,14 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // check makes sure the request has the correct method, params and
 // header values we expect
 func check(r *http.Request) bool {
-	if r.Method != "GET" && r.Method != "POST" && r.Method != "HEAD" && r.Method != "DELETE" {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "PUT" && r.Method != "HEAD" && r.Method != "DELETE" {
 		return false
 	}
 	if err := r.ParseForm(); err != nil {
 		return false
 	}
-	if r.Form.Get("name") == "" {
+	// Files sent through a form are named after the form's file parts
+	if r.Form.Get("name") == "" && !isFormUpload(r) {
 		return false
 	}
 	if r.Method == "POST" {
@@ -75,7 +291,9 @@ func check(r *http.Request) bool {
 		if err != nil {
 			return false
 		}
-		if _, err := strconv.Atoi(r.Header.Get("Content-Length")); err != nil {
+		// Streaming producers don't know the length beforehand: the body
+		// is sent chunked with HTTP/1.1, or just as it comes with HTTP/2
+		if _, err := strconv.Atoi(r.Header.Get("Content-Length")); err != nil && r.ContentLength != -1 {
 			return false
 		}
 	} else {
@@ -83,35 +301,137 @@ func check(r *http.Request) bool {
 			return false
 		}
 	}
+	if r.Method == "PUT" {
+		if _, err := strconv.Atoi(r.Header.Get("Content-Length")); err != nil && r.ContentLength != -1 {
+			return false
+		}
+	}
 	return true
 }
 
+// uploadMeta returns the metadata to store with an upload, from the
+// options given by the client
+func uploadMeta(r *http.Request, now time.Time) (meta, error) {
+	expires, err := expiryFrom(r, now)
+	if err != nil {
+		return meta{}, err
+	}
+	maxDownloads, err := maxDownloadsFrom(r)
+	if err != nil {
+		return meta{}, err
+	}
+	m := meta{Expires: expires, MaxDownloads: maxDownloads}
+	if p, ok := principalFrom(r); ok {
+		m.Owner = p.name
+	}
+	return m, nil
+}
+
 func (h handler) handlePost(w http.ResponseWriter, r *http.Request) {
-	newpath, err := h.st.Post(r.Form.Get("name"), r.Body, time.Now())
-	r.Body.Close()
+	defer r.Body.Close()
+	m, err := uploadMeta(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Don't even read the body if it can't fit
+	if !h.limitBody(w, r) {
+		return
+	}
+	if err := h.checkQuota(m.Owner, r.ContentLength); err != nil {
+		postError(w, r, err)
+		return
+	}
+	res, err := h.post(r.Form.Get("name"), r.Body, m)
 	if err != nil {
-		log.Println("Error putting:", err)
-		http.Error(w, "Error putting file", http.StatusInternalServerError)
+		postError(w, r, err)
+		return
+	}
+	writePostResult(w, res)
+}
+
+// postError answers a request whose upload failed
+func postError(w http.ResponseWriter, r *http.Request, err error) {
+	if status := quotaStatus(err); status != 0 {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if bodyError(w, err) {
 		return
 	}
-	w.Header().Set("Location", "/?name="+newpath)
-	w.WriteHeader(http.StatusCreated)
+	logError(r, "Error putting:", err)
+	http.Error(w, "Error putting file", http.StatusInternalServerError)
 }
 
 func (h handler) handleGet(w http.ResponseWriter, r *http.Request, method string) {
-	rd, modTime, err := h.st.Get(r.Form.Get("name"))
+	name := h.resolve(r)
+	m, err := h.st.Meta(name)
+	// Expired files may not have been reaped yet, but they are gone for
+	// clients
+	if err == nil && m.expired(time.Now()) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// Downloads of files with a limited number of them are counted,
+	// except for HEAD requests which don't send the content. Range
+	// requests would allow reading the whole content piece by piece
+	// without ever completing a download, so they get the whole
+	// content.
+	limited := err == nil && m.MaxDownloads > 0 && method == "GET"
+	if limited {
+		r.Header.Del("Range")
+		if err := downloads.start(h.st, name); err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	rd, modTime, err := h.st.Get(name)
 	if err != nil {
+		if limited {
+			downloads.finish(h.st, name, false)
+		}
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
-	responseWriter := w
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = rd.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		rd.Close()
+		if limited {
+			downloads.finish(h.st, name, false)
+		}
+		logError(r, "Error seeking:", err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+
+	cw := &countingWriter{ResponseWriter: w}
+	var responseWriter http.ResponseWriter = cw
 	if method == "HEAD" {
-		responseWriter = nullWriter{w}
+		responseWriter = nullWriter{cw}
 	}
-	random := path.Dir(r.Form.Get("name"))
-	w.Header().Set("Etag", random)
+	random := path.Dir(name)
+	w.Header().Set("Etag", `"`+random+`"`)
+	// Anyone who can upload chooses what files contain, and they are
+	// served from the same origin as the web UI: browsers must not run
+	// them as part of it
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
 	http.ServeContent(responseWriter, r, "", modTime, rd)
 	rd.Close()
+
+	if limited {
+		// Only a download that sent the whole content counts, not one
+		// interrupted or answered with a 304
+		completed := cw.status == http.StatusOK && cw.written == size && cw.err == nil
+		if err := downloads.finish(h.st, name, completed); err != nil {
+			logError(r, "Error counting download:", err)
+		}
+	}
 }
 
 // nullWriter is a wrapper around a http.ResponseWriter that doesn't
@@ -127,9 +447,27 @@ func (nw nullWriter) Write(p []byte) (n int, err error) {
 }
 
 func (h handler) handleDelete(w http.ResponseWriter, r *http.Request) {
-	err := h.st.Delete(r.Form.Get("name"))
+	// The versions of a stable name can't change while they are deleted
+	nameLock.Lock()
+	defer nameLock.Unlock()
+	if n, versions := h.versions(r.Form.Get("name")); len(versions) > 0 {
+		h.deleteVersions(w, r, n, r.Form.Get("name"), versions)
+		return
+	}
+	name := r.Form.Get("name")
+	m, err := h.st.Meta(name)
+	if err != nil {
+		logError(r, "Couldn't delete:", err)
+		http.Error(w, "Couldn't delete", http.StatusInternalServerError)
+		return
+	}
+	if !canDelete(r, m) {
+		http.Error(w, "Invalid delete token", http.StatusForbidden)
+		return
+	}
+	err = h.st.Delete(name)
 	if err != nil {
-		log.Println("Couldn't delete:", err)
+		logError(r, "Couldn't delete:", err)
 		http.Error(w, "Couldn't delete", http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// meta is what a store keeps about an object besides its content and
+// modification time. Stores fill in the sizes when the object is
+// posted; otherwise they don't interpret it, they only give it back as
+// it was given to them.
+type meta struct {
+	// DeleteTokenHash is the hex-encoded sha256 of the secret needed to
+	// delete the object. Objects stored before delete tokens existed
+	// don't have one.
+	DeleteTokenHash string `json:"deleteTokenHash,omitempty"`
+
+	// Expires is when the object stops being served and can be deleted.
+	// The zero value means it never expires.
+	Expires time.Time `json:"expires,omitzero"`
+
+	// MaxDownloads is how many times the object can be downloaded
+	// before it is deleted, 0 meaning no limit. Downloads is how many
+	// times it has been downloaded so far.
+	MaxDownloads int `json:"maxDownloads,omitempty"`
+	Downloads    int `json:"downloads,omitempty"`
+
+	// Owner is the name of the principal who uploaded the object, if
+	// authentication was enabled
+	Owner string `json:"owner,omitempty"`
+
+	// Size is the size of the object's content. NewBytes is how many
+	// bytes the store actually had to write for it: for a dedupStore,
+	// the size of the chunks that weren't already stored. Objects stored
+	// before sizes were recorded have neither.
+	Size     int64 `json:"size,omitempty"`
+	NewBytes int64 `json:"newBytes,omitempty"`
+}
+
+// expired tells whether the object has expired at the given time
+func (m meta) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// objectPath returns the path of the object with the given name, as
+// returned by Post, under root. The name must be made of the random
+// part and the filename; in particular, it can't point to a metadata
+// file or outside of root.
+func objectPath(root, name string) (string, error) {
+	// The random part must be longer than the fanout directory, or the
+	// name would designate a file directly under it
+	if strings.Index(name, "/") <= 2 {
+		return "", errors.New("Invalid name")
+	}
+	if _, file := path.Split(name); file == "" {
+		return "", errors.New("Invalid name")
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == "" || element == "." || element == ".." {
+			return "", errors.New("Invalid name")
+		}
+	}
+	return path.Join(root, name[:2], name[2:]), nil
+}
+
+// metaPath returns where the metadata of the object stored at filepath
+// is kept. Both fsStore and dedupStore store an object in its own
+// directory, <root>/<2 first chars of random>/<rest of random>/<name>;
+// the metadata is kept next to that directory, in
+// <root>/<2 first chars of random>/<rest of random>.meta, so it can't
+// be mistaken for an object.
+func metaPath(filepath string) string {
+	return path.Dir(filepath) + ".meta"
+}
+
+// writeMeta stores the metadata of the object stored at filepath,
+// atomically
+func writeMeta(filepath string, m meta) error {
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	root := path.Dir(path.Dir(path.Dir(filepath)))
+	return writeFileAtomic(root, metaPath(filepath), content, time.Time{})
+}
+
+// readMeta reads the metadata of the object stored at filepath. An
+// object without metadata file (stored before they existed) has empty
+// metadata.
+func readMeta(filepath string) (meta, error) {
+	var m meta
+	if _, err := os.Stat(filepath); err != nil {
+		return m, err
+	}
+	content, err := ioutil.ReadFile(metaPath(filepath))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(content, &m)
+	return m, err
+}
+
+// removeMeta removes the metadata of the object stored at filepath
+func removeMeta(filepath string) error {
+	err := os.Remove(metaPath(filepath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// discardObject removes whatever a failed Post created for the object
+// that was to be stored at filepath: the object file, its metadata, its
+// directory and, if nothing else is in it, the fanout directory
+func discardObject(filepath string) {
+	os.Remove(filepath)
+	removeMeta(filepath)
+	os.Remove(path.Dir(filepath))
+	os.Remove(path.Dir(path.Dir(filepath)))
+}
+
+// walkObjects calls fn for each object stored under root, with its name
+// as returned by Post and the path of the file holding it. Anything
+// that doesn't follow the layout of objects (such as metadata files, or
+// chunks for a dedupStore) is skipped.
+func walkObjects(root string, fn func(name, filepath string) error) error {
+	fanouts, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fanout := range fanouts {
+		if !fanout.IsDir() || len(fanout.Name()) != 2 {
+			continue
+		}
+		dirs, err := ioutil.ReadDir(path.Join(root, fanout.Name()))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if !dir.IsDir() {
+				continue
+			}
+			dirpath := path.Join(root, fanout.Name(), dir.Name())
+			files, err := ioutil.ReadDir(dirpath)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				if f.IsDir() {
+					continue
+				}
+				name := fanout.Name() + dir.Name() + "/" + f.Name()
+				if err := fn(name, path.Join(dirpath, f.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of
+// the request duration histogram; they are Prometheus' default ones
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations in latencyBuckets. counts[i] is the
+// number of observations in bucket i only; they are accumulated when
+// exposed, as Prometheus wants.
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func (hg *histogram) observe(v float64) {
+	if hg.counts == nil {
+		hg.counts = make([]int64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			hg.counts[i]++
+			break
+		}
+	}
+	hg.count++
+	hg.sum += v
+}
+
+type requestKey struct {
+	method string
+	status int
+}
+
+// metricSet holds the counters exposed on /metrics. All of them are
+// in memory, starting from zero when the server starts, as Prometheus
+// expects from counters.
+type metricSet struct {
+	mu sync.Mutex
+
+	requests map[requestKey]int64
+	latency  map[string]*histogram
+
+	uploadedBytes   int64
+	downloadedBytes int64
+
+	// Chunks a dedupStore had to write, and chunks it found already
+	// stored
+	chunksWritten     int64
+	chunkBytesWritten int64
+	chunksDeduped     int64
+	chunkBytesDeduped int64
+
+	// chunkBytes is the size of the chunks a dedupStore has on disk,
+	// once measured or changed; shared chunks count once
+	chunkBytes      int64
+	chunkBytesKnown bool
+
+	// Runs of collectors, removing unused chunks
+	gcRuns         int64
+	gcErrors       int64
+	gcFreedBytes   int64
+	gcLastRun      time.Time
+	gcLastDuration time.Duration
+}
+
+var metrics = newMetricSet()
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		requests: make(map[requestKey]int64),
+		latency:  make(map[string]*histogram),
+	}
+}
+
+// metricMethod returns the method label of a request, keeping the
+// number of label values bounded whatever clients send
+func metricMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE":
+		return method
+	}
+	return "OTHER"
+}
+
+// request records a request that has been handled
+func (ms *metricSet) request(method string, status int, duration time.Duration, uploaded, downloaded int64) {
+	method = metricMethod(method)
+	if status == 0 {
+		// Nothing was written, which net/http answers with a 200
+		status = http.StatusOK
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.requests[requestKey{method, status}]++
+	hg := ms.latency[method]
+	if hg == nil {
+		hg = &histogram{}
+		ms.latency[method] = hg
+	}
+	hg.observe(duration.Seconds())
+	ms.uploadedBytes += uploaded
+	ms.downloadedBytes += downloaded
+}
+
+// chunk records a chunk stored by a dedupStore, which had to write it
+// or not
+func (ms *metricSet) chunk(size int, written bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if written {
+		ms.chunksWritten++
+		ms.chunkBytesWritten += int64(size)
+		ms.chunkBytes += int64(size)
+		ms.chunkBytesKnown = true
+	} else {
+		ms.chunksDeduped++
+		ms.chunkBytesDeduped += int64(size)
+	}
+}
+
+// chunkBytesStored sets the size of the chunks on disk, measured when
+// the server starts
+func (ms *metricSet) chunkBytesStored(size int64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.chunkBytes = size
+	ms.chunkBytesKnown = true
+}
+
+// chunkRemoved records a chunk removed by a failed upload
+func (ms *metricSet) chunkRemoved(size int64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.chunkBytes -= size
+}
+
+// gc records a run of a collector
+func (ms *metricSet) gc(start time.Time, freed int64, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.gcRuns++
+	if err != nil {
+		ms.gcErrors++
+	}
+	ms.gcFreedBytes += freed
+	ms.chunkBytes -= freed
+	ms.gcLastRun = start
+	ms.gcLastDuration = time.Since(start)
+}
+
+// writeTo writes the metrics in the Prometheus text format, along with
+// the storage used according to u, if not nil
+func (ms *metricSet) writeTo(w io.Writer, u *usage) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	value := func(name string, v interface{}) {
+		fmt.Fprintf(w, "%s %v\n", name, v)
+	}
+
+	keys := make([]requestKey, 0, len(ms.requests))
+	for k := range ms.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	metric("httpfile_requests_total", "counter", "Requests handled, by method and status code.")
+	for _, k := range keys {
+		value(fmt.Sprintf(`httpfile_requests_total{method=%q,code="%d"}`, k.method, k.status), ms.requests[k])
+	}
+
+	methods := make([]string, 0, len(ms.latency))
+	for method := range ms.latency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	metric("httpfile_request_duration_seconds", "histogram", "Time taken to handle requests, by method.")
+	for _, method := range methods {
+		hg := ms.latency[method]
+		cumulative := int64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += hg.counts[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			value(fmt.Sprintf(`httpfile_request_duration_seconds_bucket{method=%q,le=%q}`, method, le), cumulative)
+		}
+		value(fmt.Sprintf(`httpfile_request_duration_seconds_bucket{method=%q,le="+Inf"}`, method), hg.count)
+		value(fmt.Sprintf(`httpfile_request_duration_seconds_sum{method=%q}`, method), hg.sum)
+		value(fmt.Sprintf(`httpfile_request_duration_seconds_count{method=%q}`, method), hg.count)
+	}
+
+	metric("httpfile_uploaded_bytes_total", "counter", "Bytes of request bodies read.")
+	value("httpfile_uploaded_bytes_total", ms.uploadedBytes)
+	metric("httpfile_downloaded_bytes_total", "counter", "Bytes of response bodies sent.")
+	value("httpfile_downloaded_bytes_total", ms.downloadedBytes)
+
+	metric("httpfile_chunks_written_total", "counter", "Chunks the dedup store had to write.")
+	value("httpfile_chunks_written_total", ms.chunksWritten)
+	metric("httpfile_chunk_written_bytes_total", "counter", "Bytes of the chunks the dedup store had to write.")
+	value("httpfile_chunk_written_bytes_total", ms.chunkBytesWritten)
+	metric("httpfile_chunks_deduplicated_total", "counter", "Chunks the dedup store found already stored.")
+	value("httpfile_chunks_deduplicated_total", ms.chunksDeduped)
+	metric("httpfile_chunk_deduplicated_bytes_total", "counter", "Bytes of the chunks the dedup store found already stored.")
+	value("httpfile_chunk_deduplicated_bytes_total", ms.chunkBytesDeduped)
+
+	metric("httpfile_gc_runs_total", "counter", "Runs of the collection of unused chunks.")
+	value("httpfile_gc_runs_total", ms.gcRuns)
+	metric("httpfile_gc_errors_total", "counter", "Runs of the collection of unused chunks that failed.")
+	value("httpfile_gc_errors_total", ms.gcErrors)
+	metric("httpfile_gc_freed_bytes_total", "counter", "Bytes of unused chunks removed.")
+	value("httpfile_gc_freed_bytes_total", ms.gcFreedBytes)
+	if !ms.gcLastRun.IsZero() {
+		metric("httpfile_gc_last_run_timestamp_seconds", "gauge", "When the last collection of unused chunks started.")
+		value("httpfile_gc_last_run_timestamp_seconds", ms.gcLastRun.Unix())
+		metric("httpfile_gc_last_duration_seconds", "gauge", "Time taken by the last collection of unused chunks.")
+		value("httpfile_gc_last_duration_seconds", ms.gcLastDuration.Seconds())
+	}
+
+	if u != nil {
+		total := u.total()
+		// The bytes written for each file are all on disk, except with
+		// a dedupStore where chunks outlive the file that wrote them
+		physical := total.Physical
+		if ms.chunkBytesKnown {
+			physical = ms.chunkBytes
+		}
+		metric("httpfile_stored_files", "gauge", "Files stored.")
+		value("httpfile_stored_files", total.Files)
+		metric("httpfile_stored_bytes", "gauge", "Bytes stored: the sizes of the files (logical), and the bytes on disk for them (physical).")
+		value(`httpfile_stored_bytes{kind="logical"}`, total.Logical)
+		value(`httpfile_stored_bytes{kind="physical"}`, physical)
+	}
+}
+
+// isMetricsRequest tells whether the request is for the metrics
+func isMetricsRequest(r *http.Request) bool {
+	return r.Method == "GET" && r.URL.Path == "/metrics"
+}
+
+// handleMetrics sends the metrics in the Prometheus text format
+func (h handler) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	metrics.writeTo(&buf, h.usage)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics = newMetricSet()
+	tmp, err := ioutil.TempDir("", "httpfile-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	st := dedupStore{root: tmp}
+	u, _ := newUsage(st)
+	ts := httptest.NewServer(handler{st: accountingStore{st, u}, usage: u})
+	defer ts.Close()
+
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(content)
+	var location string
+	var first postResult
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", ts.URL+"/?name=file.bin", bytes.NewReader(content))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		location = res.Header.Get("Location")
+		if i == 0 {
+			first = postResult{location, res.Header.Get(deleteTokenHeader)}
+		}
+	}
+	res, err := http.Get(ts.URL + location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res, err = http.Get(ts.URL + "/?name=aaaa/missing"); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if _, err := st.Collect(); err != nil {
+		t.Fatal(err)
+	}
+
+	values := scrapeMetrics(t, ts.URL)
+
+	for metric, expected := range map[string]string{
+		`httpfile_requests_total{method="POST",code="201"}`:                "2",
+		`httpfile_requests_total{method="GET",code="200"}`:                 "1",
+		`httpfile_requests_total{method="GET",code="404"}`:                 "1",
+		`httpfile_request_duration_seconds_count{method="POST"}`:           "2",
+		`httpfile_request_duration_seconds_bucket{method="GET",le="+Inf"}`: "2",
+		`httpfile_uploaded_bytes_total`:                                    "200000",
+		`httpfile_chunk_written_bytes_total`:                               "100000",
+		`httpfile_chunk_deduplicated_bytes_total`:                          "100000",
+		`httpfile_gc_runs_total`:                                           "1",
+		`httpfile_gc_freed_bytes_total`:                                    "0",
+		`httpfile_stored_files`:                                            "2",
+		`httpfile_stored_bytes{kind="logical"}`:                            "200000",
+		`httpfile_stored_bytes{kind="physical"}`:                           "100000",
+	} {
+		if values[metric] != expected {
+			t.Errorf("got %s = %q, expected %q", metric, values[metric], expected)
+		}
+	}
+	if values["httpfile_chunks_written_total"] != values["httpfile_chunks_deduplicated_total"] || values["httpfile_chunks_written_total"] == "0" {
+		t.Errorf("got %s chunks written and %s deduplicated, expected the same number", values["httpfile_chunks_written_total"], values["httpfile_chunks_deduplicated_total"])
+	}
+	if downloaded, _ := strconv.Atoi(values["httpfile_downloaded_bytes_total"]); downloaded < len(content) {
+		t.Errorf("got %d bytes downloaded, expected at least the file's", downloaded)
+	}
+
+	// The chunks written for the first file are still on disk once it
+	// is deleted, since the second one uses them
+	req, _ := http.NewRequest("DELETE", ts.URL+first.Location, nil)
+	req.Header.Set(deleteTokenHeader, first.DeleteToken)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if _, err := st.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	if physical := scrapeMetrics(t, ts.URL)[`httpfile_stored_bytes{kind="physical"}`]; physical != "100000" {
+		t.Errorf("got %s physical bytes after deleting the first file, expected 100000", physical)
+	}
+}
+
+// scrapeMetrics gets the metrics of the server at url, checking that
+// every line is a comment or a sample
+func scrapeMetrics(t *testing.T, url string) map[string]string {
+	res, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("got status %d and type %q, expected the metrics", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	sample := regexp.MustCompile(`^[a-z_]+(\{[a-z]+="[^"]*"(,[a-z]+="[^"]*")*\})? [-+0-9.e]+$`)
+	values := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if !sample.MatchString(line) {
+			t.Errorf("invalid line %q", line)
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		values[line[:i]] = line[i+1:]
+	}
+	return values
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	errInvalidStableName = errors.New("Invalid name")
+	errNameConflict      = errors.New("Name conflicts with another stable name")
+)
+
+// namesDirName is the directory under a store's root where stable names
+// are kept. Its name isn't 2 characters long, so it is never mistaken
+// for a fanout directory.
+const namesDirName = "names"
+
+// namer is implemented by stores that let clients give objects stable
+// names of their choosing, on top of the random ones given by Post. A
+// stable name has a list of versions, each pointing to an object; the
+// last one is the current one.
+type namer interface {
+	// Versions returns the versions of the stable name, oldest first
+	Versions(name string) ([]version, error)
+
+	// SetVersions replaces the versions of the stable name; without
+	// any, the name is removed
+	SetVersions(name string, versions []version) error
+
+	// WalkNames calls fn for each stable name, stopping at the first
+	// error
+	WalkNames(fn func(name string) error) error
+}
+
+// version is a version of a stable name
+type version struct {
+	Object  string
+	Created time.Time
+}
+
+// id returns the id of the version, which is also the entity tag of its
+// object
+func (v version) id() string {
+	return objectETag(v.Object)
+}
+
+// nameLock makes checking the versions of a stable name and changing
+// them atomic
+var nameLock sync.Mutex
+
+// nameIndex implements namer for the stores that keep files under root.
+// Each stable name is a file under <root>/names, at the path given by
+// the name, with a line per version: the name of its object and when it
+// was created. It is written atomically, so a stable name always points
+// to whole objects.
+type nameIndex struct {
+	root string
+}
+
+// validStableName tells whether name can be used as a stable name. It
+// must be made of a directory and a file, like the names given by Post,
+// but its directory can't look like their random part, so that both
+// kinds of names never collide.
+func validStableName(name string) bool {
+	dir, file := path.Split(name)
+	if dir == "" || file == "" || strings.HasPrefix(name, "/") {
+		return false
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == "" || element == "." || element == ".." {
+			return false
+		}
+	}
+	random := strings.SplitN(name, "/", 2)[0]
+	if _, err := hex.DecodeString(random); len(random) == 64 && err == nil {
+		return false
+	}
+	return true
+}
+
+func (ni nameIndex) path(name string) (string, error) {
+	if !validStableName(name) {
+		return "", errInvalidStableName
+	}
+	return path.Join(ni.root, namesDirName, name), nil
+}
+
+// nameConflict tells whether err comes from a stable name being the
+// directory of another one, or the other way around
+func nameConflict(err error) bool {
+	return errors.Is(err, syscall.EISDIR) || errors.Is(err, syscall.ENOTDIR)
+}
+
+func (ni nameIndex) versions(name string) ([]version, error) {
+	p, err := ni.path(name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(p)
+	if nameConflict(err) {
+		return nil, errNameConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []version
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		v := version{Object: fields[0]}
+		if len(fields) > 1 {
+			v.Created, _ = time.Parse(time.RFC3339Nano, fields[1])
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+func (ni nameIndex) setVersions(name string, versions []version) error {
+	p, err := ni.path(name)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return ni.remove(p)
+	}
+	var content strings.Builder
+	for _, v := range versions {
+		content.WriteString(v.Object + " " + v.Created.UTC().Format(time.RFC3339Nano) + "\n")
+	}
+	err = writeFileAtomic(ni.root, p, []byte(content.String()), time.Time{})
+	if nameConflict(err) {
+		return errNameConflict
+	}
+	return err
+}
+
+// remove removes the file of a stable name, and the directories left
+// empty by it
+func (ni nameIndex) remove(p string) error {
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	top := path.Join(ni.root, namesDirName)
+	for dir := path.Dir(p); dir != top; dir = path.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (ni nameIndex) walkNames(fn func(name string) error) error {
+	top := path.Join(ni.root, namesDirName)
+	return filepath.Walk(top, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(top, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(name))
+	})
+}
+
+func (fs fsStore) Versions(name string) ([]version, error) { return nameIndex{fs.root}.versions(name) }
+func (fs fsStore) SetVersions(name string, versions []version) error {
+	return nameIndex{fs.root}.setVersions(name, versions)
+}
+func (fs fsStore) WalkNames(fn func(name string) error) error {
+	return nameIndex{fs.root}.walkNames(fn)
+}
+
+func (ds dedupStore) Versions(name string) ([]version, error) {
+	return nameIndex{ds.root}.versions(name)
+}
+func (ds dedupStore) SetVersions(name string, versions []version) error {
+	return nameIndex{ds.root}.setVersions(name, versions)
+}
+func (ds dedupStore) WalkNames(fn func(name string) error) error {
+	return nameIndex{ds.root}.walkNames(fn)
+}
+
+// versions returns the versions of name if it is a stable name, along
+// with the store keeping them
+func (h handler) versions(name string) (namer, []version) {
+	n, ok := underlying(h.st).(namer)
+	if !ok || !validStableName(name) {
+		return nil, nil
+	}
+	versions, _ := n.Versions(name)
+	return n, versions
+}
+
+// resolve returns the object designated by the name parameter of a
+// request: for a stable name, the object of the version given by the
+// version parameter or else of the current version, otherwise the
+// object with that name. It returns "" for a version that doesn't
+// exist.
+func (h handler) resolve(r *http.Request) string {
+	name := r.Form.Get("name")
+	_, versions := h.versions(name)
+	if len(versions) == 0 {
+		return name
+	}
+	id := r.Form.Get("version")
+	if id == "" {
+		return versions[len(versions)-1].Object
+	}
+	for _, v := range versions {
+		if v.id() == id {
+			return v.Object
+		}
+	}
+	return ""
+}
+
+// objectETag returns the entity tag of an object, which is different
+// for each version of a stable name. It is sent quoted, as HTTP wants.
+func objectETag(object string) string {
+	return path.Dir(object)
+}
+
+// checkPreconditions tells whether the If-Match and If-None-Match
+// headers of the request are satisfied by the object a stable name
+// points to, or "" if it points to none
+func checkPreconditions(r *http.Request, object string) bool {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if object == "" || !etagMatches(im, objectETag(object)) {
+			return false
+		}
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if object != "" && etagMatches(inm, objectETag(object)) {
+			return false
+		}
+	}
+	return true
+}
+
+// etagMatches tells whether the list of entity tags in a header matches
+// etag. Tags can be quoted or not, and weak ones are compared as strong
+// ones since there is only one representation of an object.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+		if strings.Trim(tag, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// canReplace tells whether the request may replace the current version
+// m of a stable name
+func canReplace(r *http.Request, m meta) bool {
+	if p, ok := principalFrom(r); ok && !p.scopes.allows(scopeDelete) {
+		return false
+	}
+	return canDelete(r, m)
+}
+
+// handlePut stores the body as the new version of the stable name given
+// by the client, creating it if needed. Replacing the current version
+// needs the same rights as deleting it, including the delete scope when
+// authenticated.
+func (h handler) handlePut(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	n, ok := underlying(h.st).(namer)
+	if !ok {
+		http.Error(w, "Stable names are not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	name := r.Form.Get("name")
+	if !validStableName(name) {
+		http.Error(w, "Invalid name", http.StatusBadRequest)
+		return
+	}
+	m, err := uploadMeta(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Preconditions and rights are checked before reading the body, so
+	// that a client can't upload for nothing, and again once it is
+	// stored, in case the name moved in the meantime
+	check := func() (old string, status int) {
+		versions, err := n.Versions(name)
+		if err == errNameConflict {
+			return "", http.StatusConflict
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logError(r, "Couldn't read versions:", err)
+			return "", http.StatusInternalServerError
+		}
+		if len(versions) > 0 {
+			old = versions[len(versions)-1].Object
+		}
+		var oldMeta meta
+		if old != "" {
+			oldMeta, err = h.st.Meta(old)
+			// An object that expired or was deleted after its last
+			// download is gone, even if the name still points to it
+			if os.IsNotExist(err) || (err == nil && oldMeta.expired(time.Now())) {
+				old = ""
+			} else if err != nil {
+				logError(r, "Couldn't read metadata:", err)
+				return "", http.StatusInternalServerError
+			}
+		}
+		if !checkPreconditions(r, old) {
+			return old, http.StatusPreconditionFailed
+		}
+		if old != "" && !canReplace(r, oldMeta) {
+			return old, http.StatusForbidden
+		}
+		return old, 0
+	}
+	if _, status := check(); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if !h.limitBody(w, r) {
+		return
+	}
+	if err := h.checkQuota(m.Owner, r.ContentLength); err != nil {
+		postError(w, r, err)
+		return
+	}
+	res, err := h.post(path.Base(name), r.Body, m)
+	if err != nil {
+		postError(w, r, err)
+		return
+	}
+	object := strings.TrimPrefix(res.Location, "/?name=")
+
+	// The new content becomes the current version, and the versions
+	// the retention policy doesn't keep anymore are deleted
+	nameLock.Lock()
+	old, status := check()
+	var pruned []version
+	if status == 0 {
+		versions, _ := n.Versions(name)
+		versions = append(versions, version{Object: object, Created: time.Now()})
+		versions, pruned = h.retention.prune(versions, time.Now())
+		err := n.SetVersions(name, versions)
+		if err == errNameConflict {
+			status = http.StatusConflict
+		} else if err != nil {
+			logError(r, "Couldn't add version:", err)
+			status = http.StatusInternalServerError
+		}
+	}
+	nameLock.Unlock()
+	if status != 0 {
+		if err := h.st.Delete(object); err != nil {
+			logError(r, "Couldn't delete refused upload:", err)
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	for _, v := range pruned {
+		if err := h.st.Delete(v.Object); err != nil && !os.IsNotExist(err) {
+			logError(r, "Couldn't delete old version:", err)
+		}
+	}
+
+	res.Location = "/?name=" + name
+	w.Header().Set("Etag", `"`+objectETag(object)+`"`)
+	w.Header().Set("Location", res.Location)
+	w.Header().Set(deleteTokenHeader, res.DeleteToken)
+	w.Header().Set("Content-Type", "application/json")
+	if old == "" {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// put sends content to the stable name with the given headers
+func put(t *testing.T, url, name, content string, headers map[string]string) *http.Response {
+	req, _ := http.NewRequest("PUT", url+"/?name="+name, strings.NewReader(content))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestPut(t *testing.T) {
+	withStores(t, func(t *testing.T, st store, root string) {
+		ts := httptest.NewServer(handler{st: st})
+		defer ts.Close()
+		const name = "project/latest.tar.gz"
+
+		get := func() (string, string, int) {
+			res, err := http.Get(ts.URL + "/?name=" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			return string(content), res.Header.Get("Etag"), res.StatusCode
+		}
+
+		res := put(t, ts.URL, name, "build 1", map[string]string{"If-None-Match": "*"})
+		if res.StatusCode != http.StatusCreated || res.Header.Get("Location") != "/?name="+name {
+			t.Fatalf("got status %d and location %q, expected %d and the stable name", res.StatusCode, res.Header.Get("Location"), http.StatusCreated)
+		}
+		etag, token := res.Header.Get("Etag"), res.Header.Get(deleteTokenHeader)
+		if content, getEtag, _ := get(); content != "build 1" || getEtag != etag {
+			t.Fatalf("got %q with etag %q, expected build 1 with %q", content, getEtag, etag)
+		}
+		// The etag is a valid entity tag, that conditional requests can
+		// send back as is
+		if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+			t.Fatalf("got etag %s, expected it quoted", etag)
+		}
+		req, _ := http.NewRequest("GET", ts.URL+"/?name="+name, nil)
+		req.Header.Set("If-None-Match", etag)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotModified {
+			t.Fatalf("got status %d for a conditional GET, expected %d", res.StatusCode, http.StatusNotModified)
+		}
+
+		for _, headers := range []map[string]string{
+			{"If-None-Match": "*"},
+			{"If-Match": `"not-the-etag"`, deleteTokenHeader: token},
+			{"If-None-Match": `"` + etag + `"`, deleteTokenHeader: token},
+		} {
+			if res := put(t, ts.URL, name, "build 2", headers); res.StatusCode != http.StatusPreconditionFailed {
+				t.Fatalf("got status %d with %v, expected %d", res.StatusCode, headers, http.StatusPreconditionFailed)
+			}
+		}
+		// Replacing needs the rights to delete what is replaced
+		if res := put(t, ts.URL, name, "build 2", map[string]string{"If-Match": etag}); res.StatusCode != http.StatusForbidden {
+			t.Fatalf("got status %d without delete token, expected %d", res.StatusCode, http.StatusForbidden)
+		}
+
+		res = put(t, ts.URL, name, "build 2", map[string]string{"If-Match": `"` + etag + `"`, deleteTokenHeader: token})
+		if res.StatusCode != http.StatusOK || res.Header.Get("Etag") == etag {
+			t.Fatalf("got status %d and etag %q, expected %d and a new etag", res.StatusCode, res.Header.Get("Etag"), http.StatusOK)
+		}
+		token = res.Header.Get(deleteTokenHeader)
+		if content, _, _ := get(); content != "build 2" {
+			t.Fatalf("got %q, expected build 2", content)
+		}
+		// The replaced object is kept as a version, and nothing was left
+		// by the refused uploads
+		objects := 0
+		st.Walk(func(string, meta) error {
+			objects++
+			return nil
+		})
+		if objects != 2 {
+			t.Fatalf("got %d objects, expected 2", objects)
+		}
+
+		req, _ = http.NewRequest("DELETE", ts.URL+"/?name="+name, nil)
+		req.Header.Set(deleteTokenHeader, token)
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d for delete, expected %d", res.StatusCode, http.StatusOK)
+		}
+		if _, _, status := get(); status != http.StatusNotFound {
+			t.Fatalf("got status %d after delete, expected %d", status, http.StatusNotFound)
+		}
+		if entries, _ := ioutil.ReadDir(path.Join(root, namesDirName)); len(entries) != 0 {
+			t.Fatalf("got %d entries left in the names, expected none", len(entries))
+		}
+	})
+}
+
+func TestPutNeedsDeleteScope(t *testing.T) {
+	filename := writeTokens(t, `uploader `+hashToken("uploader-token")+` upload,read
+publisher `+hashToken("publisher-token")+` upload,delete,read
+`)
+	defer os.Remove(filename)
+	auth, err := loadTokens(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withStores(t, func(t *testing.T, st store, root string) {
+		ts := httptest.NewServer(handler{st: st, auth: auth})
+		defer ts.Close()
+
+		for _, tc := range []struct {
+			token  string
+			status int
+		}{
+			{"uploader-token", http.StatusCreated},
+			// Replacing its own content is deleting it
+			{"uploader-token", http.StatusForbidden},
+		} {
+			res := put(t, ts.URL, "project/uploader.txt", "content", map[string]string{"Authorization": "Bearer " + tc.token})
+			if res.StatusCode != tc.status {
+				t.Fatalf("[PUT with %q] got status %d, expected %d", tc.token, res.StatusCode, tc.status)
+			}
+		}
+		for _, status := range []int{http.StatusCreated, http.StatusOK} {
+			res := put(t, ts.URL, "project/publisher.txt", "content", map[string]string{"Authorization": "Bearer publisher-token"})
+			if res.StatusCode != status {
+				t.Fatalf("[PUT with delete scope] got status %d, expected %d", res.StatusCode, status)
+			}
+		}
+	})
+}
+
+func TestPutConcurrent(t *testing.T) {
+	withStores(t, func(t *testing.T, st store, root string) {
+		ts := httptest.NewServer(handler{st: st})
+		defer ts.Close()
+		const name = "project/latest.tar.gz"
+
+		res := put(t, ts.URL, name, "build 1", nil)
+		etag, token := res.Header.Get("Etag"), res.Header.Get(deleteTokenHeader)
+
+		// Updates based on the same version: only one of them wins
+		var wg sync.WaitGroup
+		statuses := make(chan int, 8)
+		for i := 0; i < cap(statuses); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				statuses <- put(t, ts.URL, name, "build 2", map[string]string{"If-Match": etag, deleteTokenHeader: token}).StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+		won := 0
+		for status := range statuses {
+			switch status {
+			case http.StatusOK:
+				won++
+			case http.StatusPreconditionFailed:
+			default:
+				t.Errorf("got status %d, expected %d or %d", status, http.StatusOK, http.StatusPreconditionFailed)
+			}
+		}
+		if won != 1 {
+			t.Fatalf("%d updates succeeded, expected 1", won)
+		}
+		objects := 0
+		st.Walk(func(string, meta) error {
+			objects++
+			return nil
+		})
+		if objects != 2 {
+			t.Fatalf("got %d objects, expected 2", objects)
+		}
+	})
+}
+
+func TestPutInvalid(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ts := httptest.NewServer(handler{st: fsStore{tmp}})
+	defer ts.Close()
+	for _, name := range []string{
+		"latest.tar.gz",
+		"project/../latest.tar.gz",
+		strings.Repeat("ab", 32) + "/latest.tar.gz",
+	} {
+		if res := put(t, ts.URL, name, "content", nil); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("got status %d for %q, expected %d", res.StatusCode, name, http.StatusBadRequest)
+		}
+	}
+
+	// A stable name can't be the directory of another one
+	for _, names := range [][2]string{
+		{"a/b/c", "a/b"},
+		{"p/q", "p/q/r"},
+	} {
+		if res := put(t, ts.URL, names[0], "content", nil); res.StatusCode != http.StatusCreated {
+			t.Fatalf("got status %d for %q, expected %d", res.StatusCode, names[0], http.StatusCreated)
+		}
+		if res := put(t, ts.URL, names[1], "content", nil); res.StatusCode != http.StatusConflict {
+			t.Errorf("got status %d for %q after %q, expected %d", res.StatusCode, names[1], names[0], http.StatusConflict)
+		}
+	}
+
+	// Stores without stable names refuse them
+	ts2 := httptest.NewServer(handler{st: newDummyStore()})
+	defer ts2.Close()
+	if res := put(t, ts2.URL, "project/latest.tar.gz", "content", nil); res.StatusCode != http.StatusNotImplemented {
+		t.Errorf("got status %d, expected %d", res.StatusCode, http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errLogicalQuota  = errors.New("Quota exceeded")
+	errPhysicalQuota = errors.New("Storage quota exceeded")
+)
+
+// parseSize parses a size in bytes, optionally followed by one of the
+// K, M, G or T suffixes (powers of 1024). "-" means no size at all, and
+// is returned as 0.
+func parseSize(s string) (int64, error) {
+	if s == "-" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K', 'k':
+			multiplier = 1 << 10
+		case 'M', 'm':
+			multiplier = 1 << 20
+		case 'G', 'g':
+			multiplier = 1 << 30
+		case 'T', 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// ownerUsage is the storage used by an owner
+type ownerUsage struct {
+	Files int `json:"files"`
+
+	// Logical is the sum of the sizes of the owner's files. Physical is
+	// the sum of the bytes the store had to write for them: with a
+	// dedupStore, a chunk counts for whoever uploaded it first, and for
+	// nobody anymore once that file is deleted, even if other files
+	// still use it.
+	Logical  int64 `json:"logical"`
+	Physical int64 `json:"physical"`
+}
+
+// usage keeps track of the storage used by each owner. It is computed
+// once from the store, then kept up to date by an accountingStore.
+type usage struct {
+	mu      sync.Mutex
+	byOwner map[string]ownerUsage
+}
+
+func newUsage(st store) (*usage, error) {
+	u := &usage{byOwner: make(map[string]ownerUsage)}
+	err := st.Walk(func(name string, m meta) error {
+		u.add(m, 1)
+		return nil
+	})
+	return u, err
+}
+
+// add adds (sign = 1) or removes (sign = -1) an object to its owner's
+// usage
+func (u *usage) add(m meta, sign int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ou := u.byOwner[m.Owner]
+	ou.Files += sign
+	ou.Logical += int64(sign) * m.Size
+	ou.Physical += int64(sign) * m.NewBytes
+	u.byOwner[m.Owner] = ou
+}
+
+func (u *usage) get(owner string) ownerUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.byOwner[owner]
+}
+
+// total returns the storage used by all owners together
+func (u *usage) total() ownerUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var total ownerUsage
+	for _, ou := range u.byOwner {
+		total.Files += ou.Files
+		total.Logical += ou.Logical
+		total.Physical += ou.Physical
+	}
+	return total
+}
+
+// accountingStore wraps a store to keep usage up to date with every
+// object that is posted or deleted, whoever does it
+type accountingStore struct {
+	store
+	usage *usage
+}
+
+// wrapper is implemented by stores that wrap another one
+type wrapper interface {
+	unwrap() store
+}
+
+func (as accountingStore) unwrap() store { return as.store }
+
+// underlying returns the store wrapped by st, if any. Optional
+// interfaces, such as collector or namer, are implemented by the
+// wrapped store: wrappers only intercept what changes objects.
+func underlying(st store) store {
+	for {
+		w, ok := st.(wrapper)
+		if !ok {
+			return st
+		}
+		st = w.unwrap()
+	}
+}
+
+func (as accountingStore) Post(name string, rd io.Reader, modTime time.Time, m meta) (newpath string, err error) {
+	newpath, err = as.store.Post(name, rd, modTime, m)
+	if err != nil {
+		return "", err
+	}
+	// The store filled in the sizes. An object that can't be accounted
+	// for isn't kept, so that usage stays right.
+	if m, err = as.store.Meta(newpath); err != nil {
+		if err := as.store.Delete(newpath); err != nil {
+			log.Printf("Couldn't delete unaccounted %s: %v", newpath, err)
+		}
+		return "", err
+	}
+	as.usage.add(m, 1)
+	return newpath, nil
+}
+
+func (as accountingStore) Delete(name string) error {
+	m, err := as.store.Meta(name)
+	if err != nil {
+		return err
+	}
+	if err := as.store.Delete(name); err != nil {
+		return err
+	}
+	as.usage.add(m, -1)
+	return nil
+}
+
+// quotaLimit is how much an owner can store. 0 means no limit.
+type quotaLimit struct {
+	Logical  int64
+	Physical int64
+}
+
+// quotas holds the limits of each owner
+type quotas struct {
+	limits map[string]quotaLimit
+
+	// def applies to owners without limits of their own
+	def quotaLimit
+}
+
+// loadQuotas reads the quotas file. Each line gives the name of an
+// owner (or * for everyone else), the logical quota and the physical
+// quota, separated by spaces, eg:
+//
+//	alice 10G 2G
+//	*     1G  -
+//
+// Sizes are parsed by parseSize; - or 0 mean no limit. Empty lines and
+// lines starting with # are ignored.
+func loadQuotas(filename string) (*quotas, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	q := &quotas{limits: make(map[string]quotaLimit)}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected 3 fields, got %d", filename, lineno, len(fields))
+		}
+		var limit quotaLimit
+		if limit.Logical, err = parseSize(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		if limit.Physical, err = parseSize(fields[2]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		if fields[0] == "*" {
+			q.def = limit
+		} else {
+			q.limits[fields[0]] = limit
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *quotas) limitFor(owner string) quotaLimit {
+	if limit, ok := q.limits[owner]; ok {
+		return limit
+	}
+	return q.def
+}
+
+// checkQuota tells whether owner can store length more bytes (-1 if
+// unknown). Since the physical size of an upload can't be known
+// beforehand, only owners already over their physical quota are
+// refused here.
+func (h handler) checkQuota(owner string, length int64) error {
+	if h.quotas == nil {
+		return nil
+	}
+	limit, used := h.quotas.limitFor(owner), h.usage.get(owner)
+	if limit.Logical > 0 && (used.Logical >= limit.Logical || used.Logical+length > limit.Logical) {
+		return errLogicalQuota
+	}
+	if limit.Physical > 0 && used.Physical >= limit.Physical {
+		return errPhysicalQuota
+	}
+	return nil
+}
+
+// quotaReader fails once more than remaining bytes are read
+type quotaReader struct {
+	rd        io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (qr *quotaReader) Read(p []byte) (n int, err error) {
+	n, err = qr.rd.Read(p)
+	qr.remaining -= int64(n)
+	if qr.remaining < 0 {
+		qr.exceeded = true
+		return n, errLogicalQuota
+	}
+	return n, err
+}
+
+// postWithQuota posts the content through h.st while enforcing the
+// quotas of owner: the logical quota as the content is read, the
+// physical one once the store has told how much it actually wrote, by
+// removing the object if it went over. Several uploads by the same
+// owner in parallel can go over the quota, by at most their sizes.
+func (h handler) postWithQuota(name string, rd io.Reader, modTime time.Time, m meta) (string, error) {
+	if h.quotas == nil {
+		return h.st.Post(name, rd, modTime, m)
+	}
+	if err := h.checkQuota(m.Owner, 0); err != nil {
+		return "", err
+	}
+	limit, used := h.quotas.limitFor(m.Owner), h.usage.get(m.Owner)
+	var qr *quotaReader
+	if limit.Logical > 0 {
+		qr = &quotaReader{rd: rd, remaining: limit.Logical - used.Logical}
+		rd = qr
+	}
+	newpath, err := h.st.Post(name, rd, modTime, m)
+	if qr != nil && qr.exceeded {
+		if err == nil {
+			h.st.Delete(newpath)
+		}
+		return "", errLogicalQuota
+	}
+	if err != nil || limit.Physical == 0 {
+		return newpath, err
+	}
+	stored, err := h.st.Meta(newpath)
+	if err != nil {
+		return "", err
+	}
+	if used.Physical+stored.NewBytes > limit.Physical {
+		if err := h.st.Delete(newpath); err != nil {
+			log.Println("Couldn't delete upload over quota:", err)
+		}
+		return "", errPhysicalQuota
+	}
+	return newpath, nil
+}
+
+// partQuota returns the body of a request sending a part of a
+// multi-part upload of owner, failing with errLogicalQuota once it goes
+// over their quota. The parts they hold in their open sessions count as
+// used: they aren't stored objects yet, but take space all the same.
+func (h handler) partQuota(owner string, r *http.Request) (io.Reader, error) {
+	if h.quotas == nil {
+		return r.Body, nil
+	}
+	held, err := h.uploads.held(owner)
+	if err != nil {
+		return nil, err
+	}
+	length := held
+	if r.ContentLength > 0 {
+		length += r.ContentLength
+	}
+	if err := h.checkQuota(owner, length); err != nil {
+		return nil, err
+	}
+	limit := h.quotas.limitFor(owner)
+	if limit.Logical == 0 {
+		return r.Body, nil
+	}
+	return &quotaReader{rd: r.Body, remaining: limit.Logical - h.usage.get(owner).Logical - held}, nil
+}
+
+// quotaStatus returns the status code to answer an error from a post
+// with, or 0 if it isn't about quotas
+func quotaStatus(err error) int {
+	switch err {
+	case errLogicalQuota:
+		return http.StatusRequestEntityTooLarge
+	case errPhysicalQuota:
+		return http.StatusInsufficientStorage
+	}
+	return 0
+}
+
+// isUsageRequest tells whether the request asks for the storage used
+// by the principal
+func isUsageRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["usage"]
+	return r.Method == "GET" && ok
+}
+
+// handleUsage sends the storage used by the principal making the
+// request, and their quotas, as JSON. Like for listing, admins can get
+// the usage of someone else with the owner parameter.
+func (h handler) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if h.usage == nil {
+		http.Error(w, "Usage is not tracked", http.StatusBadRequest)
+		return
+	}
+	p, _ := principalFrom(r)
+	owner := p.name
+	if other := r.URL.Query().Get("owner"); other != "" && other != owner {
+		if !p.scopes.allows(scopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		owner = other
+	}
+	res := struct {
+		Owner string `json:"owner"`
+		ownerUsage
+		LogicalQuota  int64 `json:"logicalQuota,omitempty"`
+		PhysicalQuota int64 `json:"physicalQuota,omitempty"`
+	}{Owner: owner, ownerUsage: h.usage.get(owner)}
+	if h.quotas != nil {
+		limit := h.quotas.limitFor(owner)
+		res.LogicalQuota, res.PhysicalQuota = limit.Logical, limit.Physical
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"-":    0,
+		"0":    0,
+		"123":  123,
+		"2K":   2 << 10,
+		"10M":  10 << 20,
+		"1g":   1 << 30,
+		"3T":   3 << 40,
+		"15kK": -1,
+		"-1":   -1,
+		"G":    -1,
+		"":     -1,
+	} {
+		n, err := parseSize(s)
+		if expected < 0 {
+			if err == nil {
+				t.Errorf("got %d for %q, expected an error", n, s)
+			}
+			continue
+		}
+		if err != nil || n != expected {
+			t.Errorf("got %d (err=%v) for %q, expected %d", n, err, s, expected)
+		}
+	}
+}
+
+func TestLogicalQuota(t *testing.T) {
+	st := newDummyStore()
+	u, _ := newUsage(st)
+	h := handler{
+		st:     accountingStore{st, u},
+		usage:  u,
+		quotas: &quotas{def: quotaLimit{Logical: 20}},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	post := func(content string) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+"/?name=file.txt", bytes.NewReader([]byte(content)))
+		req.Header.Set("Content-Type", "text/plain")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := post("fifteen bytes.."); res.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d, expected %d", res.StatusCode, http.StatusCreated)
+	}
+	if res := post("fifteen bytes.."); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d over quota, expected %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	if res := post("five."); res.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d for what still fits, expected %d", res.StatusCode, http.StatusCreated)
+	}
+	if used := u.get(""); used.Files != 2 || used.Logical != 20 {
+		t.Fatalf("got usage %+v, expected 2 files and 20 bytes", used)
+	}
+
+	res, err := http.Get(ts.URL + "/?usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Files        int   `json:"files"`
+		Logical      int64 `json:"logical"`
+		LogicalQuota int64 `json:"logicalQuota"`
+	}
+	json.NewDecoder(res.Body).Decode(&got)
+	res.Body.Close()
+	if got.Files != 2 || got.Logical != 20 || got.LogicalQuota != 20 {
+		t.Fatalf("got usage %+v from endpoint, expected 2 files, 20 bytes and 20 bytes quota", got)
+	}
+
+	// Deleting, whoever does it, frees the quota
+	for name := range st.files {
+		if err := h.st.Delete(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if used := u.get(""); used.Files != 0 || used.Logical != 0 {
+		t.Fatalf("got usage %+v after deleting everything, expected nothing", used)
+	}
+}
+
+func TestPartQuota(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	st := newDummyStore()
+	u, _ := newUsage(st)
+	h := handler{
+		st:      accountingStore{st, u},
+		uploads: uploadSessions{tmp},
+		usage:   u,
+		quotas:  &quotas{def: quotaLimit{Logical: 20}},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	initiate := func() string {
+		res := doRequest(t, "POST", ts.URL+"/?uploads&name=parts.txt", nil)
+		res.Body.Close()
+		location, _ := url.Parse(res.Header.Get("Location"))
+		return location.Query().Get("uploadId")
+	}
+	putPart := func(id string, body io.Reader) int {
+		req, _ := http.NewRequest("PUT", ts.URL+"/?partNumber=1&uploadId="+id, body)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	first, second := initiate(), initiate()
+	if status := putPart(first, strings.NewReader("fifteen bytes..")); status != http.StatusOK {
+		t.Fatalf("got status %d, expected %d", status, http.StatusOK)
+	}
+	// Parts of open sessions count, whichever session they are in
+	if status := putPart(second, strings.NewReader("fifteen bytes..")); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d over quota, expected %d", status, http.StatusRequestEntityTooLarge)
+	}
+	// Even when their length isn't known beforehand
+	if status := putPart(second, io.MultiReader(strings.NewReader("ten bytes."))); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d over quota without length, expected %d", status, http.StatusRequestEntityTooLarge)
+	}
+	if status := putPart(second, strings.NewReader("five.")); status != http.StatusOK {
+		t.Fatalf("got status %d for what still fits, expected %d", status, http.StatusOK)
+	}
+
+	// Aborting a session frees what its parts held
+	doRequest(t, "DELETE", ts.URL+"/?uploadId="+first, nil).Body.Close()
+	if status := putPart(second, strings.NewReader("fifteen bytes..")); status != http.StatusOK {
+		t.Fatalf("got status %d after abort, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestPhysicalQuota(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ds := dedupStore{root: tmp}
+	u, _ := newUsage(ds)
+	h := handler{
+		st:     accountingStore{ds, u},
+		usage:  u,
+		quotas: &quotas{limits: map[string]quotaLimit{"": {Physical: 150000}}},
+	}
+
+	rnd := rand.New(rand.NewSource(3))
+	first := make([]byte, 100000)
+	rnd.Read(first)
+	second := make([]byte, 100000)
+	rnd.Read(second)
+
+	if _, err := h.post("first", bytes.NewReader(first), meta{}); err != nil {
+		t.Fatal(err)
+	}
+	// The same content again is free
+	if _, err := h.post("again", bytes.NewReader(first), meta{}); err != nil {
+		t.Fatal(err)
+	}
+	if used := u.get(""); used.Logical != 200000 || used.Physical != 100000 {
+		t.Fatalf("got usage %+v, expected 200000 logical and 100000 physical bytes", used)
+	}
+	if _, err := h.post("second", bytes.NewReader(second), meta{}); err != errPhysicalQuota {
+		t.Fatalf("got %v for new content over quota, expected %v", err, errPhysicalQuota)
+	}
+	if used := u.get(""); used.Files != 2 || used.Physical != 100000 {
+		t.Fatalf("got usage %+v after refused upload, expected it unchanged", used)
+	}
+}
+
+// unreadableMetaStore fails to read the metadata of its objects
+type unreadableMetaStore struct {
+	*dummyStore
+}
+
+func (us unreadableMetaStore) Meta(name string) (meta, error) {
+	return meta{}, errors.New("injected failure")
+}
+
+func TestAccountingUnreadableMeta(t *testing.T) {
+	st := newDummyStore()
+	u, _ := newUsage(st)
+	as := accountingStore{unreadableMetaStore{st}, u}
+	if _, err := as.Post("file.txt", strings.NewReader("content"), time.Now(), meta{}); err == nil {
+		t.Fatal("expected an error when the metadata can't be read")
+	}
+	// The object isn't kept, since it couldn't be accounted for
+	if len(st.files) != 0 {
+		t.Fatalf("got %d files stored, expected none", len(st.files))
+	}
+	if used := u.get(""); used.Files != 0 {
+		t.Fatalf("got usage %+v, expected nothing", used)
+	}
+}
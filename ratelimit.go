@@ -0,0 +1,295 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a classic token bucket: it holds up to burst tokens
+// and is refilled with rate tokens per second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if now.After(tb.last) {
+		tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+		tb.last = now
+	}
+}
+
+// allow takes n tokens if there are enough of them. Otherwise it
+// returns how long to wait until there are.
+func (tb *tokenBucket) allow(n float64, now time.Time) (ok bool, wait time.Duration) {
+	tb.refill(now)
+	if tb.tokens >= n {
+		tb.tokens -= n
+		return true, 0
+	}
+	return false, tb.wait(n - tb.tokens)
+}
+
+// reserve takes n tokens even if there aren't enough of them, and
+// returns how long to wait until the bucket isn't in debt anymore
+func (tb *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	tb.refill(now)
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return tb.wait(-tb.tokens)
+}
+
+func (tb *tokenBucket) wait(missing float64) time.Duration {
+	return time.Duration(missing / tb.rate * float64(time.Second))
+}
+
+func (tb *tokenBucket) full(now time.Time) bool {
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
+
+// rateLimiter limits what each client can do: how many requests per
+// second, how many bytes per second they can upload and how many
+// uploads they can run at the same time. A client is whoever the token
+// was given to if the request is authenticated, its IP otherwise.
+// Limits that are 0 aren't enforced.
+//
+// Requests are counted against their IP before authentication, so that
+// tokens can't be guessed faster than the request rate; those that turn
+// out to be authenticated are then counted against their principal
+// instead.
+type rateLimiter struct {
+	requestRate  float64
+	requestBurst int
+	uploadRate   int64
+	maxUploads   int
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+// client is the state of the limits of a single client
+type client struct {
+	requests *tokenBucket
+	bytes    *tokenBucket
+	uploads  int
+}
+
+// sweepInterval is how often clients back to their full allowance are
+// forgotten, so that the rateLimiter doesn't grow forever
+const sweepInterval = time.Minute
+
+func newRateLimiter(requestRate float64, requestBurst int, uploadRate int64, maxUploads int) *rateLimiter {
+	if requestBurst < 1 {
+		requestBurst = 1
+	}
+	return &rateLimiter{
+		requestRate:  requestRate,
+		requestBurst: requestBurst,
+		uploadRate:   uploadRate,
+		maxUploads:   maxUploads,
+		clients:      make(map[string]*client),
+		lastSweep:    time.Now(),
+	}
+}
+
+// clientKey identifies the client making the request
+func clientKey(r *http.Request) string {
+	if p, ok := principalFrom(r); ok {
+		return "token:" + p.name
+	}
+	return addressKey(r)
+}
+
+// addressKey identifies the IP the request comes from
+func addressKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// client returns the state of the given client, creating it if needed.
+// rl.mu must be held.
+func (rl *rateLimiter) client(key string, now time.Time) *client {
+	if now.Sub(rl.lastSweep) > sweepInterval {
+		for k, c := range rl.clients {
+			if c.uploads == 0 && (c.requests == nil || c.requests.full(now)) && (c.bytes == nil || c.bytes.full(now)) {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &client{}
+		if rl.requestRate > 0 {
+			c.requests = newTokenBucket(rl.requestRate, float64(rl.requestBurst), now)
+		}
+		if rl.uploadRate > 0 {
+			// A second worth of bytes can be sent at once
+			c.bytes = newTokenBucket(float64(rl.uploadRate), float64(rl.uploadRate), now)
+		}
+		rl.clients[key] = c
+	}
+	return c
+}
+
+// admit counts a request against the IP it comes from, before it is
+// authenticated. If it is refused, it returns how long the client
+// should wait before retrying.
+func (rl *rateLimiter) admit(key string, now time.Time) (retryAfter time.Duration, ok bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	c := rl.client(key, now)
+	if c.requests == nil {
+		return 0, true
+	}
+	ok, retryAfter = c.requests.allow(1, now)
+	return retryAfter, ok
+}
+
+// refund gives back the request counted by admit, once it is known to
+// be counted against a principal
+func (rl *rateLimiter) refund(key string, now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if c := rl.client(key, now); c.requests != nil {
+		c.requests.tokens = math.Min(c.requests.burst, c.requests.tokens+1)
+	}
+}
+
+// start accounts for a new request from the client, counting it against
+// the request rate if count is set. If it is refused, it returns how
+// long the client should wait before retrying; otherwise done must be
+// called once the request is over.
+func (rl *rateLimiter) start(key string, count, upload bool, now time.Time) (done func(), retryAfter time.Duration, ok bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	c := rl.client(key, now)
+	if upload {
+		if rl.maxUploads > 0 && c.uploads >= rl.maxUploads {
+			// There is no telling when an upload will finish
+			return nil, time.Second, false
+		}
+		// A client still paying for previous uploads has to wait
+		if c.bytes != nil {
+			if ok, wait := c.bytes.allow(0, now); !ok {
+				return nil, wait, false
+			}
+		}
+	}
+	if c.requests != nil && count {
+		if ok, wait := c.requests.allow(1, now); !ok {
+			return nil, wait, false
+		}
+	}
+	if !upload {
+		return func() {}, 0, true
+	}
+	c.uploads++
+	return func() {
+		rl.mu.Lock()
+		c.uploads--
+		rl.mu.Unlock()
+	}, 0, true
+}
+
+// throttle waits as long as needed for the client to stay under its
+// upload rate after having sent n more bytes
+func (rl *rateLimiter) throttle(key string, n int) {
+	rl.mu.Lock()
+	c := rl.client(key, time.Now())
+	var wait time.Duration
+	if c.bytes != nil {
+		wait = c.bytes.reserve(float64(n), time.Now())
+	}
+	rl.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// throttledReader slows reading down to the upload rate of a client
+type throttledReader struct {
+	rc  io.ReadCloser
+	rl  *rateLimiter
+	key string
+}
+
+func (tr throttledReader) Read(p []byte) (n int, err error) {
+	n, err = tr.rc.Read(p)
+	if n > 0 {
+		tr.rl.throttle(tr.key, n)
+	}
+	return n, err
+}
+
+func (tr throttledReader) Close() error {
+	return tr.rc.Close()
+}
+
+// isUploadingRequest tells whether the request sends content to be
+// stored, either a whole file or a part of one
+func isUploadingRequest(r *http.Request) bool {
+	return (r.Method == "POST" && !isSignRequest(r)) || r.Method == "PUT"
+}
+
+// tooManyRequests answers a request refused by the rate limiter
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// limitAddress enforces the request rate of the IP the request comes
+// from, before authentication. If the request is refused a 429 is sent
+// with a Retry-After header, and false is returned.
+func (h handler) limitAddress(w http.ResponseWriter, r *http.Request) bool {
+	if h.limiter == nil {
+		return true
+	}
+	retryAfter, ok := h.limiter.admit(addressKey(r), time.Now())
+	if !ok {
+		tooManyRequests(w, retryAfter)
+	}
+	return ok
+}
+
+// rateLimit enforces the limits of the client making the request, once
+// authenticated. If the request is refused a 429 is sent with a
+// Retry-After header, and false is returned; otherwise done must be
+// called once the request is over.
+func (h handler) rateLimit(w http.ResponseWriter, r *http.Request) (done func(), ok bool) {
+	if h.limiter == nil {
+		return func() {}, true
+	}
+	key := clientKey(r)
+	upload := isUploadingRequest(r)
+	// Requests without a principal were already counted by
+	// limitAddress
+	_, authenticated := principalFrom(r)
+	if authenticated {
+		h.limiter.refund(addressKey(r), time.Now())
+	}
+	done, retryAfter, ok := h.limiter.start(key, authenticated, upload, time.Now())
+	if !ok {
+		tooManyRequests(w, retryAfter)
+		return nil, false
+	}
+	if upload && h.limiter.uploadRate > 0 {
+		r.Body = throttledReader{rc: r.Body, rl: h.limiter, key: key}
+	}
+	return done, true
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(2, 4, now)
+	for i := 0; i < 4; i++ {
+		if ok, _ := tb.allow(1, now); !ok {
+			t.Fatalf("request %d refused within the burst", i)
+		}
+	}
+	if ok, wait := tb.allow(1, now); ok || wait != 500*time.Millisecond {
+		t.Fatalf("got ok=%v and wait=%s after the burst, expected to wait 500ms", ok, wait)
+	}
+	if ok, _ := tb.allow(1, now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("request refused after waiting")
+	}
+	if wait := tb.reserve(3, now.Add(500*time.Millisecond)); wait != 1500*time.Millisecond {
+		t.Fatalf("got wait=%s when going into debt, expected 1.5s", wait)
+	}
+	if !tb.full(now.Add(4 * time.Second)) {
+		t.Fatal("bucket not full after a long time")
+	}
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	filename := writeTokens(t, "alice "+hashToken("alice-token")+" upload,read\n"+
+		"bob "+hashToken("bob-token")+" upload,read\n")
+	defer os.Remove(filename)
+	auth, err := loadTokens(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(handler{st: newDummyStore(), auth: auth, limiter: newRateLimiter(0.1, 2, 0, 0)})
+	defer ts.Close()
+
+	get := func(token string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/?list", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	for i := 0; i < 2; i++ {
+		if res := get("alice-token"); res.StatusCode != http.StatusOK {
+			t.Fatalf("[GET %d] got status %d within the burst, expected %d", i, res.StatusCode, http.StatusOK)
+		}
+	}
+	res := get("alice-token")
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("[GET] got status %d after the burst, expected %d", res.StatusCode, http.StatusTooManyRequests)
+	}
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter != "10" {
+		t.Fatalf("got Retry-After %q, expected 10", retryAfter)
+	}
+	// Other clients have their own limits
+	if res := get("bob-token"); res.StatusCode != http.StatusOK {
+		t.Fatalf("[GET as bob] got status %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestRateLimitAuthFailures(t *testing.T) {
+	filename := writeTokens(t, "alice "+hashToken("alice-token")+" upload,read\n")
+	defer os.Remove(filename)
+	auth, err := loadTokens(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(handler{st: newDummyStore(), auth: auth, limiter: newRateLimiter(0.1, 2, 0, 0)})
+	defer ts.Close()
+
+	get := func(token string) int {
+		req, _ := http.NewRequest("GET", ts.URL+"/?list", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Guessing tokens counts against the IP
+	for i := 0; i < 2; i++ {
+		if status := get("guessed"); status != http.StatusUnauthorized {
+			t.Fatalf("[GET %d] got status %d with an invalid token, expected %d", i, status, http.StatusUnauthorized)
+		}
+	}
+	if status := get("guessed"); status != http.StatusTooManyRequests {
+		t.Fatalf("[GET] got status %d after the burst, expected %d", status, http.StatusTooManyRequests)
+	}
+	if status := get("alice-token"); status != http.StatusTooManyRequests {
+		t.Fatalf("[GET] got status %d from the same IP, expected %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestConcurrentUploadLimit(t *testing.T) {
+	st := newDummyStore()
+	ts := httptest.NewServer(handler{st: st, limiter: newRateLimiter(0, 0, 0, 1)})
+	defer ts.Close()
+
+	post := func(rd io.Reader) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+"/?name=file.txt", rd)
+		req.Header.Set("Content-Type", "text/plain")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// The first upload is kept in progress until its body is closed
+	pr, pw := io.Pipe()
+	first := make(chan int)
+	go func() {
+		first <- post(pr).StatusCode
+	}()
+	pw.Write([]byte("slow content"))
+
+	res := post(strings.NewReader("content"))
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("got status %d during another upload, expected %d with Retry-After", res.StatusCode, http.StatusTooManyRequests)
+	}
+	pw.Close()
+	if status := <-first; status != http.StatusCreated {
+		t.Fatalf("got status %d for first upload, expected %d", status, http.StatusCreated)
+	}
+	if res := post(strings.NewReader("content")); res.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d after the first upload, expected %d", res.StatusCode, http.StatusCreated)
+	}
+}
+
+func TestUploadRate(t *testing.T) {
+	ts := httptest.NewServer(handler{st: newDummyStore(), limiter: newRateLimiter(0, 0, 1000, 0)})
+	defer ts.Close()
+
+	// The first 1000 bytes go through at once, the next 500 take half a
+	// second
+	start := time.Now()
+	postWithQuery(t, ts.URL, "name=file.txt", strings.Repeat("a", 1500))
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("upload took %s, expected it to be throttled", elapsed)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainingHandler keeps track of the requests being handled by h, so
+// that shutting down can wait for all of them to be over, including the
+// ones whose connections had to be closed: their handlers still have
+// to clean up what they were writing.
+type drainingHandler struct {
+	h http.Handler
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inflight int
+	closed   bool
+}
+
+func newDrainingHandler(h http.Handler) *drainingHandler {
+	dh := &drainingHandler{h: h}
+	dh.cond = sync.NewCond(&dh.mu)
+	return dh
+}
+
+func (dh *drainingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dh.mu.Lock()
+	if dh.closed {
+		dh.mu.Unlock()
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	dh.inflight++
+	dh.mu.Unlock()
+
+	defer func() {
+		dh.mu.Lock()
+		dh.inflight--
+		dh.cond.Broadcast()
+		dh.mu.Unlock()
+	}()
+	dh.h.ServeHTTP(w, r)
+}
+
+// wait refuses new requests and waits for the ones in flight to be over
+func (dh *drainingHandler) wait() {
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+	dh.closed = true
+	for dh.inflight > 0 {
+		dh.cond.Wait()
+	}
+}
+
+// shutdown stops the servers from accepting new requests and lets the
+// ones in flight finish for at most timeout. After that, their
+// connections are closed, making uploads fail: stores then remove what
+// they had written. It returns once all handlers are done.
+func shutdown(servers []*http.Server, dh *drainingHandler, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Requests still in flight on %s after %s, closing them", srv.Addr, timeout)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	dh.wait()
+}
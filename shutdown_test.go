@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startServer serves h on a random port, returning the server and its
+// URL
+func startServer(t *testing.T, h http.Handler) (*http.Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(ln)
+	return srv, "http://" + ln.Addr().String()
+}
+
+// slowPost starts an upload whose body is only sent once the returned
+// writer is closed, and waits for dh to be handling it. Its status code
+// is sent on the returned channel, or 0 if it failed.
+func slowPost(t *testing.T, dh *drainingHandler, url string) (*io.PipeWriter, chan int) {
+	pr, pw := io.Pipe()
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", url+"/?name=slow.txt", pr)
+		req.Header.Set("Content-Type", "text/plain")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	pw.Write([]byte("slow content"))
+	for {
+		dh.mu.Lock()
+		inflight := dh.inflight
+		dh.mu.Unlock()
+		if inflight > 0 {
+			return pw, status
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	dh := newDrainingHandler(handler{st: newDummyStore()})
+	srv, url := startServer(t, dh)
+
+	pw, status := slowPost(t, dh, url)
+	done := make(chan struct{})
+	go func() {
+		shutdown([]*http.Server{srv}, dh, 5*time.Second)
+		close(done)
+	}()
+
+	// New connections are refused while the upload finishes
+	time.Sleep(50 * time.Millisecond)
+	if res, err := http.Get(url + "/?name=a/b"); err == nil {
+		res.Body.Close()
+		t.Fatalf("got status %d during shutdown, expected the connection to be refused", res.StatusCode)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the upload finished")
+	default:
+	}
+
+	pw.Close()
+	if s := <-status; s != http.StatusCreated {
+		t.Fatalf("got status %d for upload in flight, expected %d", s, http.StatusCreated)
+	}
+	<-done
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	withStores(t, func(t *testing.T, st store, root string) {
+		dh := newDrainingHandler(handler{st: st})
+		srv, url := startServer(t, dh)
+
+		pw, _ := slowPost(t, dh, url)
+		defer pw.Close()
+		start := time.Now()
+		shutdown([]*http.Server{srv}, dh, 100*time.Millisecond)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("shutdown took %s, expected it to give up after the timeout", elapsed)
+		}
+
+		// The cut upload left nothing behind
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				content, _ := ioutil.ReadFile(p)
+				t.Errorf("found %s (%q) after shutdown", p, content)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSignTTL is how long a signed URL is valid when the admin
+// doesn't say
+const defaultSignTTL = time.Hour
+
+// urlSigner mints and verifies signed URLs: links that allow anyone to
+// read a file until a given time, without any token. A signed URL is
+// the usual GET URL with two more parameters:
+//
+//	/?name=<name>&expires=<unix timestamp>&sig=<hex-encoded HMAC-SHA256>
+//
+// where the HMAC is computed with a server key over the name and the
+// expiry time. Several keys can be configured to allow for rotation:
+// the first one signs, all of them are accepted when verifying, so a
+// new key can be added in front and the old one removed once all the
+// URLs it signed have expired.
+type urlSigner struct {
+	keys [][]byte
+}
+
+var (
+	errBadSignature = errors.New("Invalid signature")
+	errExpired      = errors.New("Signed URL has expired")
+)
+
+// loadSigningKeys reads the signing keys file: one hex-encoded key per
+// line, the first one being used to sign. Empty lines and lines
+// starting with # are ignored.
+func loadSigningKeys(filename string) (*urlSigner, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	us := &urlSigner{}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid hex key", filename, lineno)
+		}
+		if len(key) < 16 {
+			return nil, fmt.Errorf("%s:%d: key too short, need at least 16 bytes", filename, lineno)
+		}
+		us.keys = append(us.keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(us.keys) == 0 {
+		return nil, fmt.Errorf("%s: no key", filename)
+	}
+	return us, nil
+}
+
+func (us *urlSigner) mac(key []byte, name, expires string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(name + "\n" + expires))
+	return m.Sum(nil)
+}
+
+// sign returns the signed URL allowing to read name until expires
+func (us *urlSigner) sign(name string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	v := url.Values{}
+	v.Set("name", name)
+	v.Set("expires", exp)
+	v.Set("sig", hex.EncodeToString(us.mac(us.keys[0], name, exp)))
+	return "/?" + v.Encode()
+}
+
+// verify checks that sig is a valid signature of name and expires by
+// any of the keys, and that the expiry time hasn't passed
+func (us *urlSigner) verify(name, expires, sig string, now time.Time) error {
+	rawSig, err := hex.DecodeString(sig)
+	if err != nil {
+		return errBadSignature
+	}
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errBadSignature
+	}
+	valid := false
+	for _, key := range us.keys {
+		if hmac.Equal(rawSig, us.mac(key, name, expires)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return errBadSignature
+	}
+	if now.Unix() >= exp {
+		return errExpired
+	}
+	return nil
+}
+
+// isSignedRequest tells whether the request uses a signed URL
+func isSignedRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["sig"]
+	return ok
+}
+
+// signedExcluded are the parameters of the endpoints other than reading
+// an object, which a signed URL must not reach
+var signedExcluded = []string{"stats", "list", "usage", "versions", "sign", "uploads", "uploadId"}
+
+// checkSignature verifies a signed URL before anything else is done
+// with the request. Signed URLs only allow reading the object they
+// name; the signature replaces authentication, so that links can be
+// handed out to people who don't have a token.
+func (h handler) checkSignature(w http.ResponseWriter, r *http.Request) bool {
+	if (r.Method != "GET" && r.Method != "HEAD") || r.URL.Path != "/" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return false
+	}
+	for _, param := range signedExcluded {
+		if _, ok := r.URL.Query()[param]; ok {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return false
+		}
+	}
+	if h.signer == nil {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return false
+	}
+	q := r.URL.Query()
+	err := h.signer.verify(q.Get("name"), q.Get("expires"), q.Get("sig"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// isSignRequest tells whether the request asks for a signed URL to be
+// minted
+func isSignRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["sign"]
+	return r.Method == "POST" && ok
+}
+
+// handleSign mints a signed URL for the name parameter, valid for the
+// duration in the ttl parameter (eg "90m", default one hour). The
+// response is a JSON object with the URL.
+func (h handler) handleSign(w http.ResponseWriter, r *http.Request) {
+	if h.signer == nil {
+		http.Error(w, "Signed URLs are not enabled", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	name := q.Get("name")
+	if name == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultSignTTL
+	if q.Get("ttl") != "" {
+		var err error
+		ttl, err = time.ParseDuration(q.Get("ttl"))
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		URL string `json:"url"`
+	}{h.signer.sign(name, time.Now().Add(ttl))})
+}
+
+// signCommand implements "httpfile sign": it prints a signed URL for a
+// file, for admins who have access to the keys but would rather not go
+// through the server
+func signCommand(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keys := fs.String("signing-keys", "", "file with the keys used to sign URLs")
+	ttl := fs.Duration("ttl", defaultSignTTL, "how long the URL is valid")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: httpfile sign -signing-keys <file> [-ttl <duration>] <name>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *keys == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	signer, err := loadSigningKeys(*keys)
+	if err != nil {
+		log.Fatal("Couldn't load signing keys: ", err)
+	}
+	fmt.Println(signer.sign(fs.Arg(0), time.Now().Add(*ttl)))
+}
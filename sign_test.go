@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	old := &urlSigner{keys: [][]byte{[]byte("0123456789abcdef")}}
+	rotated := &urlSigner{keys: [][]byte{[]byte("fedcba9876543210"), []byte("0123456789abcdef")}}
+	now := time.Now()
+
+	verify := func(us *urlSigner, signed string, now time.Time) error {
+		u, _ := url.Parse(signed)
+		q := u.Query()
+		return us.verify(q.Get("name"), q.Get("expires"), q.Get("sig"), now)
+	}
+
+	signed := old.sign("random/file.txt", now.Add(time.Minute))
+	if err := verify(old, signed, now); err != nil {
+		t.Fatal(err)
+	}
+	// URLs signed with a previous key are still valid after rotation...
+	if err := verify(rotated, signed, now); err != nil {
+		t.Fatal(err)
+	}
+	// ... but not when the key is removed
+	if err := verify(&urlSigner{keys: rotated.keys[:1]}, signed, now); err != errBadSignature {
+		t.Fatalf("got %v for removed key, expected %v", err, errBadSignature)
+	}
+	if err := verify(old, signed, now.Add(2*time.Minute)); err != errExpired {
+		t.Fatalf("got %v after expiry, expected %v", err, errExpired)
+	}
+
+	// Tampering with any parameter invalidates the signature
+	for _, tampered := range []string{
+		strings.Replace(signed, "file.txt", "other.txt", 1),
+		strings.Replace(signed, "expires=", "expires=1", 1),
+	} {
+		if err := verify(old, tampered, now); err != errBadSignature {
+			t.Fatalf("got %v for %s, expected %v", err, tampered, errBadSignature)
+		}
+	}
+}
+
+func TestHandleSigned(t *testing.T) {
+	filename := writeTokens(t, "admin "+hashToken("admin-token")+" admin\n")
+	defer os.Remove(filename)
+	auth, err := loadTokens(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &urlSigner{keys: [][]byte{[]byte("0123456789abcdef")}}
+	ts := httptest.NewServer(handler{st: newDummyStore(), auth: auth, signer: signer})
+	defer ts.Close()
+
+	do := func(method, target, token string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+target, strings.NewReader("content"))
+		req.Header.Set("Content-Type", "text/plain")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := do("POST", "/?name=content.txt", "admin-token")
+	res.Body.Close()
+	location, _ := url.Parse(res.Header.Get("Location"))
+	name := location.Query().Get("name")
+
+	// Minting requires the admin scope
+	if res := do("POST", "/?sign&ttl=10m&name="+url.QueryEscape(name), ""); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("[sign] got status %d without token, expected %d", res.StatusCode, http.StatusUnauthorized)
+	}
+	res = do("POST", "/?sign&ttl=10m&name="+url.QueryEscape(name), "admin-token")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("[sign] got status %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+	var signed struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// The signed URL works without token, for reading only
+	if res := do("GET", signed.URL, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("[GET] got status %d for signed URL, expected %d", res.StatusCode, http.StatusOK)
+	}
+	if res := do("DELETE", signed.URL, ""); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("[DELETE] got status %d for signed URL, expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+	// Nor does it give access to the other endpoints, which need a
+	// token
+	for _, target := range []string{
+		signed.URL + "&stats",
+		signed.URL + "&list",
+		signed.URL + "&usage",
+		signed.URL + "&versions",
+		signed.URL + "&uploadId=1",
+		"/metrics" + strings.TrimPrefix(signed.URL, "/"),
+	} {
+		if res := do("GET", target, ""); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("[GET] got status %d for %s, expected %d", res.StatusCode, target, http.StatusBadRequest)
+		}
+	}
+	expired := signer.sign(name, time.Now().Add(-time.Minute))
+	if res := do("GET", expired, ""); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("[GET] got status %d for expired URL, expected %d", res.StatusCode, http.StatusForbidden)
+	}
+	forged := strings.Replace(signed.URL, "sig=", "sig=00", 1)
+	if res := do("GET", forged, ""); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("[GET] got status %d for forged URL, expected %d", res.StatusCode, http.StatusForbidden)
+	}
+}
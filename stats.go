@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// defaultStatsTop is how many files are listed by their contribution
+// to the storage, unless asked otherwise
+const defaultStatsTop = 10
+
+var errNoStats = errors.New("Statistics are only available for the dedup store")
+
+// dedupStats describes how much a dedupStore saves
+type dedupStats struct {
+	// Files is the number of objects stored, and Logical the sum of
+	// their sizes
+	Files   int   `json:"files"`
+	Logical int64 `json:"logical"`
+
+	// Chunks is the number of chunks stored, and Physical the sum of
+	// their sizes. Chunks not used anymore count until they are
+	// collected.
+	Chunks   int   `json:"chunks"`
+	Physical int64 `json:"physical"`
+
+	// Ratio is Logical / Physical: how many times bigger the storage
+	// would be without deduplication
+	Ratio float64 `json:"ratio"`
+
+	ChunkSizes []chunkSizeBucket `json:"chunkSizes"`
+
+	// Top are the files that would free the most space if deleted, ie
+	// those with the most bytes in chunks used by no other file
+	Top []fileContribution `json:"top"`
+}
+
+// chunkSizeBucket counts the chunks bigger than half of Max, up to Max
+type chunkSizeBucket struct {
+	Max    int64 `json:"max"`
+	Chunks int   `json:"chunks"`
+}
+
+type fileContribution struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	UniqueBytes int64  `json:"uniqueBytes"`
+}
+
+// statser is implemented by stores that can report their deduplication
+type statser interface {
+	Stats(top int) (dedupStats, error)
+}
+
+// Stats computes the statistics of the store from a full scan, listing
+// the top files by their contribution. Chunks can't be collected in
+// the meantime, but uploads go on.
+func (ds dedupStore) Stats(top int) (stats dedupStats, err error) {
+	chunkLock.RLock()
+	defer chunkLock.RUnlock()
+
+	sizes := make(map[string]int64)
+	buckets := make(map[int64]int)
+	err = ds.walkChunks(func(hash string, info os.FileInfo) error {
+		sizes[hash] = info.Size()
+		stats.Chunks++
+		stats.Physical += info.Size()
+		max := int64(1)
+		for max < info.Size() {
+			max *= 2
+		}
+		buckets[max]++
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	for max, n := range buckets {
+		stats.ChunkSizes = append(stats.ChunkSizes, chunkSizeBucket{max, n})
+	}
+	sort.Slice(stats.ChunkSizes, func(i, j int) bool {
+		return stats.ChunkSizes[i].Max < stats.ChunkSizes[j].Max
+	})
+
+	// The chunks of each file are counted once for it, however many
+	// times it contains them
+	type object struct {
+		name   string
+		size   int64
+		chunks map[string]bool
+	}
+	var objects []object
+	users := make(map[string]int)
+	err = walkObjects(ds.root, func(name, filepath string) error {
+		chunkList, err := ioutil.ReadFile(filepath)
+		if os.IsNotExist(err) {
+			// deleted in the meantime
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		o := object{name: name, chunks: make(map[string]bool)}
+		for _, hash := range strings.Split(string(chunkList), "\n") {
+			o.size += sizes[hash]
+			if !o.chunks[hash] {
+				o.chunks[hash] = true
+				users[hash]++
+			}
+		}
+		objects = append(objects, o)
+		stats.Files++
+		stats.Logical += o.size
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if stats.Physical > 0 {
+		stats.Ratio = float64(stats.Logical) / float64(stats.Physical)
+	}
+
+	contributions := make([]fileContribution, 0, len(objects))
+	for _, o := range objects {
+		fc := fileContribution{Name: o.name, Size: o.size}
+		for hash := range o.chunks {
+			if users[hash] == 1 {
+				fc.UniqueBytes += sizes[hash]
+			}
+		}
+		contributions = append(contributions, fc)
+	}
+	sort.Slice(contributions, func(i, j int) bool {
+		if contributions[i].UniqueBytes != contributions[j].UniqueBytes {
+			return contributions[i].UniqueBytes > contributions[j].UniqueBytes
+		}
+		return contributions[i].Name < contributions[j].Name
+	})
+	if len(contributions) > top {
+		contributions = contributions[:top]
+	}
+	stats.Top = contributions
+	return stats, nil
+}
+
+// writeStats writes a human-readable report of stats
+func writeStats(w io.Writer, stats dedupStats) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Files:\t%d\n", stats.Files)
+	fmt.Fprintf(tw, "Logical bytes:\t%d\n", stats.Logical)
+	fmt.Fprintf(tw, "Unique chunks:\t%d\n", stats.Chunks)
+	fmt.Fprintf(tw, "Physical bytes:\t%d\n", stats.Physical)
+	fmt.Fprintf(tw, "Dedup ratio:\t%.2f\n", stats.Ratio)
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nChunk sizes:")
+	for _, b := range stats.ChunkSizes {
+		fmt.Fprintf(tw, "  <= %d\t%d\n", b.Max, b.Chunks)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nTop files by unique bytes:")
+	fmt.Fprintf(tw, "  name\tunique bytes\tsize\n")
+	for _, fc := range stats.Top {
+		fmt.Fprintf(tw, "  %s\t%d\t%d\n", fc.Name, fc.UniqueBytes, fc.Size)
+	}
+	tw.Flush()
+}
+
+// isStatsRequest tells whether the request asks for the statistics of
+// the store
+func isStatsRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["stats"]
+	return r.Method == "GET" && ok
+}
+
+// handleStats sends the statistics of the store as JSON, with the
+// number of top files given by the top parameter
+func (h handler) handleStats(w http.ResponseWriter, r *http.Request) {
+	top := defaultStatsTop
+	if s := r.URL.Query().Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid top", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	s, ok := underlying(h.st).(statser)
+	if !ok {
+		http.Error(w, errNoStats.Error(), http.StatusBadRequest)
+		return
+	}
+	stats, err := s.Stats(top)
+	if err != nil {
+		logError(r, "Error computing statistics:", err)
+		http.Error(w, "Error computing statistics", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// statsCommand prints the statistics of the dedup store under a root,
+// without a running server
+func statsCommand(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	root := fs.String("root", defaultConfig().Root, "directory files are stored in")
+	top := fs.Int("top", defaultStatsTop, "number of files to list by their unique bytes")
+	asJSON := fs.Bool("json", false, "print the statistics as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: httpfile stats [-root <dir>] [-top <n>] [-json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *top < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, err := os.Stat(*root); err != nil {
+		log.Fatal(err)
+	}
+	stats, err := dedupStore{root: *root}.Stats(*top)
+	if err != nil {
+		log.Fatal("Couldn't compute statistics: ", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+		return
+	}
+	writeStats(os.Stdout, stats)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDedupStats(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	st := dedupStore{root: tmp}
+
+	rnd := rand.New(rand.NewSource(2))
+	shared := make([]byte, 100000)
+	unique := make([]byte, 50000)
+	rnd.Read(shared)
+	rnd.Read(unique)
+	for _, content := range [][]byte{shared, shared} {
+		if _, err := st.Post("shared.bin", bytes.NewReader(content), time.Now(), meta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uniqueName, err := st.Post("unique.bin", bytes.NewReader(unique), time.Now(), meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := st.Stats(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 3 || stats.Logical != 250000 || stats.Physical != 150000 {
+		t.Fatalf("got %d files, %d logical bytes and %d physical, expected 3, 250000 and 150000", stats.Files, stats.Logical, stats.Physical)
+	}
+	if ratio := 250000.0 / 150000; stats.Ratio != ratio {
+		t.Fatalf("got ratio %f, expected %f", stats.Ratio, ratio)
+	}
+	chunks := 0
+	for _, b := range stats.ChunkSizes {
+		chunks += b.Chunks
+	}
+	if chunks != stats.Chunks || chunks < 2 {
+		t.Fatalf("got %d chunks in the histogram, expected %d", chunks, stats.Chunks)
+	}
+	expected := []fileContribution{{uniqueName, 50000, 50000}}
+	if len(stats.Top) != 1 || stats.Top[0] != expected[0] {
+		t.Fatalf("got top %+v, expected %+v", stats.Top, expected)
+	}
+
+	ts := httptest.NewServer(handler{st: st})
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/?stats&top=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got dedupStats
+	err = json.NewDecoder(res.Body).Decode(&got)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK || len(got.Top) != 3 || got.Physical != 150000 {
+		t.Fatalf("got status %d and %+v (err=%v), expected the statistics with 3 files", res.StatusCode, got, err)
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	// Only the dedup store has statistics
+	ts := httptest.NewServer(handler{st: newDummyStore()})
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/?stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d, expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	// They are for admins only
+	if s := requiredScope(httptest.NewRequest("GET", "/?stats", nil)); s != scopeAdmin {
+		t.Fatalf("got scope %d, expected admin", s)
+	}
+}
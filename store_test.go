@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withStores runs fn against each of the on-disk stores, each rooted
+// in its own temporary directory
+func withStores(t *testing.T, fn func(t *testing.T, st store, root string)) {
+	for _, tc := range []struct {
+		name string
+		new  func(root string) store
+	}{
+		{"fsStore", func(root string) store { return fsStore{root} }},
+		{"dedupStore", func(root string) store { return dedupStore{root: root} }},
+	} {
+		tmp, err := ioutil.TempDir("", "httpfile-"+tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			fn(t, tc.new(tmp), tmp)
+		})
+		os.RemoveAll(tmp)
+	}
+}
+
+func TestStoreMeta(t *testing.T) {
+	withStores(t, func(t *testing.T, st store, root string) {
+		m := meta{DeleteTokenHash: hashDeleteToken("secret")}
+		name, err := st.Post("content.txt", bytes.NewReader([]byte("some content")), time.Now(), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := st.Meta(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Size, m.NewBytes = 12, 12
+		if got != m {
+			t.Fatalf("got meta %+v, expected %+v", got, m)
+		}
+
+		// The metadata can't be fetched as an object
+		metaName := path.Dir(name) + ".meta"
+		if _, _, err := st.Get(metaName); err == nil {
+			t.Fatalf("metadata readable as object %s", metaName)
+		}
+
+		if err := st.Delete(name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.Meta(name); err == nil {
+			t.Fatal("got meta for deleted object")
+		}
+		if _, err := os.Stat(metaPath(path.Join(root, name[:2], name[2:]))); !os.IsNotExist(err) {
+			t.Fatalf("metadata file still exists after delete: %v", err)
+		}
+	})
+}
+
+func TestObjectPath(t *testing.T) {
+	for _, invalid := range []string{
+		"",
+		"ab",
+		"abcdef",
+		"ab/file",
+		"abcdef/",
+		"abcdef//file",
+		"abcdef/../../file",
+		"abcdef/./file",
+	} {
+		if p, err := objectPath("data", invalid); err == nil {
+			t.Errorf("got path %s for invalid name %q", p, invalid)
+		}
+	}
+	p, err := objectPath("data", "abcdef/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "data/ab/cdef/file" {
+		t.Fatalf("got path %s, expected data/ab/cdef/file", p)
+	}
+}
+
+func TestDedupStoreNewBytes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-newbytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ds := dedupStore{root: tmp}
+
+	content := []byte("some content stored twice")
+	for i, expected := range []int64{int64(len(content)), 0} {
+		name, err := ds.Post("content.txt", bytes.NewReader(content), time.Now(), meta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ds.Meta(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Size != int64(len(content)) || m.NewBytes != expected {
+			t.Fatalf("[%d] got size %d and %d new bytes, expected %d and %d", i, m.Size, m.NewBytes, len(content), expected)
+		}
+	}
+}
+
+// TestDedupStoreSlowUpload checks that an upload in progress neither
+// blocks the other ones, even failing, nor Collect, and that its chunks
+// survive a collection made in the meantime
+func TestDedupStoreSlowUpload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ds := dedupStore{root: tmp, splitBits: 10}
+
+	content := make([]byte, 200000)
+	rand.New(rand.NewSource(5)).Read(content)
+	pr, pw := io.Pipe()
+	type result struct {
+		name string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		name, err := ds.Post("slow.bin", pr, time.Now(), meta{})
+		slow <- result{name, err}
+	}()
+	pw.Write(content[:100000])
+	for chunks := 0; chunks == 0; {
+		ds.walkChunks(func(string, os.FileInfo) error {
+			chunks++
+			return nil
+		})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	withTimeout := func(what string, fn func() error) {
+		done := make(chan error, 1)
+		go func() { done <- fn() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("%s: %v", what, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s is blocked by the upload in progress", what)
+		}
+	}
+	withTimeout("failing upload", func() error {
+		rd := &failingReader{bytes.NewReader(content[100:]), 5000}
+		if _, err := ds.Post("failing.bin", rd, time.Now(), meta{}); err == nil {
+			return errors.New("cut upload succeeded")
+		}
+		return nil
+	})
+	withTimeout("upload", func() error {
+		_, err := ds.Post("tiny.txt", strings.NewReader("tiny"), time.Now(), meta{})
+		return err
+	})
+	withTimeout("Collect", func() error {
+		_, err := ds.Collect()
+		return err
+	})
+
+	pw.Write(content[100000:])
+	pw.Close()
+	res := <-slow
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	rd, _, err := ds.Get(res.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	got, err := ioutil.ReadAll(rd)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("got %d bytes (err=%v), expected the whole content", len(got), err)
+	}
+}
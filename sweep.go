@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// sweepStale removes what uploads interrupted by a crash left behind in
+// st, stored under root, and in the multi-part upload sessions under
+// uploads: temporary files, metadata of objects that were never
+// written, empty object directories and, if st has any, unused chunks.
+// It must only be run when no upload is in flight, ie at startup. It
+// returns the number of leftovers removed, not counting chunks.
+func sweepStale(st store, root, uploads string) (removed int, err error) {
+	remove := func(p string) error {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	}
+
+	tmps, err := ioutil.ReadDir(path.Join(root, tmpDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, tmp := range tmps {
+		if err := remove(path.Join(root, tmpDirName, tmp.Name())); err != nil {
+			return removed, err
+		}
+	}
+
+	// Chunks go before directories, which may be left empty
+	if c, ok := underlying(st).(collector); ok {
+		if _, err := c.Collect(); err != nil {
+			return removed, err
+		}
+	}
+
+	fanouts, err := ioutil.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, fanout := range fanouts {
+		if !fanout.IsDir() || len(fanout.Name()) != 2 {
+			continue
+		}
+		fanoutPath := path.Join(root, fanout.Name())
+		entries, err := ioutil.ReadDir(fanoutPath)
+		if err != nil {
+			return removed, err
+		}
+		// Empty object directories go first, so that their metadata is
+		// then seen as orphan
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			dir := path.Join(fanoutPath, entry.Name())
+			if files, err := ioutil.ReadDir(dir); err == nil && len(files) == 0 {
+				if err := remove(dir); err != nil {
+					return removed, err
+				}
+			}
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+				continue
+			}
+			metaFile := path.Join(fanoutPath, entry.Name())
+			if _, err := os.Stat(strings.TrimSuffix(metaFile, ".meta")); os.IsNotExist(err) {
+				if err := remove(metaFile); err != nil {
+					return removed, err
+				}
+			}
+		}
+		if rest, err := ioutil.ReadDir(fanoutPath); err == nil && len(rest) == 0 {
+			if err := remove(fanoutPath); err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	// Parts being received are written to temporary files in their
+	// session directory
+	sessions, err := ioutil.ReadDir(uploads)
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, session := range sessions {
+		if !session.IsDir() {
+			continue
+		}
+		parts, err := ioutil.ReadDir(path.Join(uploads, session.Name()))
+		if err != nil {
+			return removed, err
+		}
+		for _, p := range parts {
+			if strings.HasPrefix(p.Name(), "tmp") {
+				if err := remove(path.Join(uploads, session.Name(), p.Name())); err != nil {
+					return removed, err
+				}
+			}
+		}
+	}
+	return removed, nil
+}
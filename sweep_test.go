@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSweepStale crashes a Post at every step, and checks that sweeping
+// afterwards leaves nothing but the objects entirely stored
+func TestSweepStale(t *testing.T) {
+	content := make([]byte, 200000)
+	rand.New(rand.NewSource(4)).Read(content)
+
+	withStores(t, func(t *testing.T, st store, root string) {
+		uploads, err := ioutil.TempDir("", "httpfile-uploads")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(uploads)
+		us := uploadSessions{uploads}
+		id, err := us.create("content.bin", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(uploads, id, "tmp123"), []byte("part"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		for n := 1; postCrashing(t, st, content, n); n++ {
+		}
+		removed, err := sweepStale(st, root, uploads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed == 0 {
+			t.Fatal("nothing was removed")
+		}
+		checkConsistency(t, st, root, content)
+
+		// Each object remaining has its file and its metadata; for a
+		// dedupStore, the only other files are the chunks they use
+		objects := 0
+		st.Walk(func(string, meta) error {
+			objects++
+			return nil
+		})
+		var objectFiles, metaFiles int
+		for _, f := range storedFiles(t, root) {
+			switch {
+			case strings.HasSuffix(f, ".meta"):
+				metaFiles++
+			case strings.Count(f, "/") == 2:
+				objectFiles++
+			case strings.Count(f, "/") == 1 && len(path.Base(f)) == 62 && !strings.HasPrefix(f, tmpDirName):
+			default:
+				t.Errorf("%s left after sweeping", f)
+			}
+		}
+		if objectFiles != objects || metaFiles != objects {
+			t.Errorf("%d object files and %d metadata files left, expected %d of each", objectFiles, metaFiles, objects)
+		}
+		if files := storedFiles(t, uploads); len(files) != 2 {
+			t.Errorf("%v left in the upload session, expected only its name and owner", files)
+		}
+
+		// The store is usable as usual
+		if _, err := st.Post("content.bin", bytes.NewReader(content), time.Now(), meta{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
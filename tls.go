@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a certificate that is reloaded from its files
+// when they change or the process gets a SIGHUP. Only new connections
+// get the new certificate, existing ones are left alone.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	return cr, cr.reload()
+}
+
+// reload loads the certificate from its files. If they are invalid,
+// eg because they are being replaced, the current certificate is kept.
+func (cr *certReloader) reload() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert, cr.modTime = &cert, modTime
+	cr.mu.Unlock()
+	return nil
+}
+
+// filesModTime returns the modification time of the latest of the
+// certificate and key files
+func (cr *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, filename := range []string{cr.certFile, cr.keyFile} {
+		st, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reloadIfChanged reloads the certificate if its files changed since
+// it was last loaded
+func (cr *certReloader) reloadIfChanged() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	changed := !modTime.Equal(cr.modTime)
+	cr.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	return cr.reload()
+}
+
+// watch reloads the certificate on SIGHUP and when its files change
+func (cr *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(certCheckInterval)
+	for {
+		var err error
+		select {
+		case <-hup:
+			err = cr.reload()
+		case <-ticker.C:
+			err = cr.reloadIfChanged()
+		}
+		if err != nil {
+			log.Println("Couldn't reload certificate:", err)
+		}
+	}
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.cert, nil
+}
+
+// newTLSConfig returns the TLS configuration of the server, serving the
+// certificate of cr. If clientCA isn't empty, clients can authenticate
+// with a certificate signed by one of the CAs in that file.
+func newTLSConfig(cr *certReloader, clientCA string) (*tls.Config, error) {
+	tc := &tls.Config{
+		GetCertificate: cr.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found", clientCA)
+		}
+		tc.ClientCAs = pool
+		// Clients without certificate can still use a token
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+// loadClientCerts reads the file mapping client certificates to
+// principals, adding them to ta. Each line gives the name of the
+// principal, its comma-separated scopes and the subject of its
+// certificate, as the rest of the line, eg:
+//
+//	alice upload,read CN=alice,O=Example Corp
+//
+// Empty lines and lines starting with # are ignored.
+func loadClientCerts(filename string, ta *tokenAuth) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if ta.subjects == nil {
+		ta.subjects = make(map[string]principal)
+	}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return fmt.Errorf("%s:%d: expected a name, scopes and a subject", filename, lineno)
+		}
+		p := principal{name: fields[0]}
+		if p.scopes, err = parseScopes(fields[1]); err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		subject := strings.Join(fields[2:], " ")
+		if _, ok := ta.subjects[subject]; ok {
+			return fmt.Errorf("%s:%d: duplicate subject", filename, lineno)
+		}
+		ta.subjects[subject] = p
+	}
+	return scanner.Err()
+}
+
+// redirectHandler redirects everything to the same URL over HTTPS, on
+// the port given
+type redirectHandler struct {
+	httpsPort string
+}
+
+func (rh redirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if host == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if rh.httpsPort != "443" {
+		host = net.JoinHostPort(host, rh.httpsPort)
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	// Clients may not send the body again after a 301
+	status := http.StatusPermanentRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, target, status)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// newCert returns a certificate for the given subject, signed by
+// parent (self-signed if nil), along with its key
+func newCert(t *testing.T, serial int64, subject pkix.Name, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newServerCert(t *testing.T, serial int64) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return newCert(t, serial, pkix.Name{CommonName: "localhost"}, nil, nil)
+}
+
+// writeCert writes the certificate and its key as PEM files in dir
+func writeCert(t *testing.T, dir string, cert *x509.Certificate, key *ecdsa.PrivateKey) (certFile, keyFile string) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	serial := func(cr *certReloader) int64 {
+		cert, _ := cr.getCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	cert, key := newServerCert(t, 1)
+	certFile, keyFile := writeCert(t, tmp, cert, key)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.reloadIfChanged(); err != nil || serial(cr) != 1 {
+		t.Fatalf("got certificate %d (err=%v) without change, expected 1", serial(cr), err)
+	}
+
+	cert, key = newServerCert(t, 2)
+	writeCert(t, tmp, cert, key)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if err := cr.reloadIfChanged(); err != nil || serial(cr) != 2 {
+		t.Fatalf("got certificate %d (err=%v) after change, expected 2", serial(cr), err)
+	}
+
+	// A broken certificate, eg half written, doesn't replace the current
+	// one
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	if err := cr.reload(); err == nil {
+		t.Fatal("got no error reloading a broken certificate")
+	}
+	if serial(cr) != 2 {
+		t.Fatalf("got certificate %d after failed reload, expected 2", serial(cr))
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ca, caKey := newCert(t, 1, pkix.Name{CommonName: "Test CA"}, nil, nil)
+	clientCert, clientKey := newCert(t, 2, pkix.Name{CommonName: "alice", Organization: []string{"Example Corp"}}, ca, caKey)
+	caFile, _ := writeCert(t, tmp, ca, caKey)
+
+	certsFile := path.Join(tmp, "client-certs.txt")
+	ioutil.WriteFile(certsFile, []byte("alice upload,read "+clientCert.Subject.String()+"\n"), 0600)
+	auth := &tokenAuth{tokens: make(map[string]principal)}
+	if err := loadClientCerts(certsFile, auth); err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, serverKey := newServerCert(t, 3)
+	cr := &certReloader{cert: &tls.Certificate{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}}
+	tlsConfig, err := newTLSConfig(cr, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(handler{st: newDummyStore(), auth: auth})
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	get := func(certs []tls.Certificate) int {
+		// httptest adds its own certificate, the server name makes sure
+		// ours is used
+		tlsConfig := &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certs}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		res, err := client.Get(ts.URL + "/?list")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := get(nil); status != http.StatusUnauthorized {
+		t.Fatalf("got status %d without certificate, expected %d", status, http.StatusUnauthorized)
+	}
+	if status := get([]tls.Certificate{{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}}); status != http.StatusOK {
+		t.Fatalf("got status %d with certificate, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	for _, tt := range []struct {
+		method, port, expected string
+		status                 int
+	}{
+		{"GET", "443", "https://example.com/?name=a/b", http.StatusMovedPermanently},
+		{"POST", "8443", "https://example.com:8443/?name=a/b", http.StatusPermanentRedirect},
+	} {
+		w := httptest.NewRecorder()
+		redirectHandler{tt.port}.ServeHTTP(w, httptest.NewRequest(tt.method, "http://example.com:8080/?name=a/b", nil))
+		if w.Code != tt.status || w.Header().Get("Location") != tt.expected {
+			t.Errorf("[%s] got status %d and Location %q, expected %d and %q", tt.method, w.Code, w.Header().Get("Location"), tt.status, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+)
+
+// templatesFS holds the pages of the web UI, embedded in the binary so
+// that the server stays a single file to deploy
+//
+//go:embed templates
+var templatesFS embed.FS
+
+var uiTemplates = template.Must(template.ParseFS(templatesFS, "templates/*.html"))
+
+// isUIRequest tells whether the request is for the web UI, ie a plain
+// GET on / without any parameter
+func isUIRequest(r *http.Request) bool {
+	return r.Method == "GET" && r.URL.Path == "/" && r.URL.RawQuery == ""
+}
+
+// handleUI serves the upload page. Everything the page does goes
+// through the usual POST/GET/DELETE API; the list of recent uploads is
+// kept in the browser's local storage, not on the server.
+func (h handler) handleUI(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := uiTemplates.ExecuteTemplate(&buf, "index.html", nil); err != nil {
+		logError(r, "Error rendering UI:", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleUI(t *testing.T) {
+	ts := httptest.NewServer(handler{st: newDummyStore()})
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("got Content-Type %s, expected text/html", res.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), `type="file"`) {
+		t.Fatal("upload page has no file input")
+	}
+
+	// Parameters mean the API is used, not the UI
+	res, err = http.Get(ts.URL + "/?name=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d for API request, expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestDownloadSandboxed(t *testing.T) {
+	st := newDummyStore()
+	ts := httptest.NewServer(handler{st: st})
+	defer ts.Close()
+
+	// An uploaded page must not be able to run scripts on the origin of
+	// the UI, where tokens are kept
+	page := "<html><script>alert(localStorage.length)</script></html>"
+	name, err := st.Post("page.html", strings.NewReader(page), time.Now(), meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get(ts.URL + "/?name=" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+	if nosniff := res.Header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+		t.Fatalf("got X-Content-Type-Options %q, expected nosniff", nosniff)
+	}
+	if csp := res.Header.Get("Content-Security-Policy"); csp != "sandbox" {
+		t.Fatalf("got Content-Security-Policy %q, expected sandbox", csp)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPartNumber is the highest part number a client may use in a
+// multi-part upload
+const maxPartNumber = 10000
+
+// uploadSessions keeps track of multi-part uploads in progress, in the
+// spirit of S3's multipart API: a client initiates a session for a
+// given name, sends numbered parts (in any order, possibly in
+// parallel), then completes the session with the list of parts it
+// wants, in order. Only at that point is the content handed to the
+// store, as a single stream: for a dedupStore this means chunk
+// boundaries are exactly the same as if the file had been uploaded in
+// one go.
+//
+// Each session is a directory under root, named by a random id. It
+// contains a "name" file holding the name the client asked for, an
+// "owner" file holding the principal who initiated it (empty without
+// authentication), and one file per received part, named
+// "<number>.<etag>" where etag is the hex-encoded sha256 of the part's
+// content. Sending the same part number twice keeps both copies; the
+// part list given at completion decides which one is used. Sessions
+// that are never completed nor aborted are removed by expire, going by
+// the modification time of their "name" file, ie when they were
+// initiated.
+type uploadSessions struct {
+	root string
+}
+
+// part identifies a part in the list sent by a client to complete a
+// session
+type part struct {
+	number int
+	etag   string
+}
+
+var errInvalidSession = errors.New("Invalid upload session")
+
+// create initiates a new session for the given name and owner, and
+// returns its id
+func (us uploadSessions) create(name, owner string) (id string, err error) {
+	var random [32]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	id = hex.EncodeToString(random[:])
+	dir := path.Join(us.root, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "owner"), []byte(owner), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "name"), []byte(name), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return id, nil
+}
+
+// owner returns who initiated the session
+func (us uploadSessions) owner(id string) (string, error) {
+	dir, err := us.sessionDir(id)
+	if err != nil {
+		return "", err
+	}
+	owner, err := ioutil.ReadFile(path.Join(dir, "owner"))
+	return string(owner), err
+}
+
+// held returns the bytes held by the parts of the sessions of owner,
+// counting those still being received
+func (us uploadSessions) held(owner string) (int64, error) {
+	sessions, err := ioutil.ReadDir(us.root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, session := range sessions {
+		dir := path.Join(us.root, session.Name())
+		o, err := ioutil.ReadFile(path.Join(dir, "owner"))
+		if err != nil || string(o) != owner {
+			continue
+		}
+		// The session may be completed or aborted meanwhile
+		parts, _ := ioutil.ReadDir(dir)
+		for _, p := range parts {
+			if p.Name() != "name" && p.Name() != "owner" {
+				total += p.Size()
+			}
+		}
+	}
+	return total, nil
+}
+
+// sessionDir returns the directory of the given session, making sure
+// it exists
+func (us uploadSessions) sessionDir(id string) (string, error) {
+	if len(id) != 64 {
+		return "", errInvalidSession
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", errInvalidSession
+	}
+	dir := path.Join(us.root, id)
+	if _, err := os.Stat(path.Join(dir, "name")); err != nil {
+		return "", errInvalidSession
+	}
+	return dir, nil
+}
+
+// putPart stores the content of part number n and returns its etag.
+// The part is first written to a temporary file then renamed, so that
+// a failed or concurrent upload of the same part never leaves a
+// truncated part visible.
+func (us uploadSessions) putPart(id string, n int, rd io.Reader) (etag string, err error) {
+	if n < 1 || n > maxPartNumber {
+		return "", fmt.Errorf("Invalid part number %d", n)
+	}
+	dir, err := us.sessionDir(id)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), rd)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	etag = hex.EncodeToString(h.Sum(nil))
+	err = os.Rename(f.Name(), path.Join(dir, strconv.Itoa(n)+"."+etag))
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return etag, nil
+}
+
+// parseParts reads the list of parts sent by the client to complete a
+// session: one part per line, as the part number and its etag
+// separated by a space. Part numbers must be strictly increasing.
+func parseParts(rd io.Reader) ([]part, error) {
+	var parts []part
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid part line %q", line)
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil || n < 1 || n > maxPartNumber {
+			return nil, fmt.Errorf("Invalid part number %q", fields[0])
+		}
+		if len(parts) > 0 && parts[len(parts)-1].number >= n {
+			return nil, errors.New("Part numbers must be in increasing order")
+		}
+		etag := strings.Trim(fields[1], `"`)
+		if _, err := hex.DecodeString(etag); err != nil || len(etag) != 64 {
+			return nil, fmt.Errorf("Invalid etag %q", fields[1])
+		}
+		parts = append(parts, part{number: n, etag: etag})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, errors.New("No parts given")
+	}
+	return parts, nil
+}
+
+// complete checks that all the given parts have been received and
+// returns the name of the session along with a reader over the
+// concatenation of the parts. The caller must close the reader, then
+// remove the session with abort.
+func (us uploadSessions) complete(id string, parts []part) (name string, rd io.ReadCloser, err error) {
+	dir, err := us.sessionDir(id)
+	if err != nil {
+		return "", nil, err
+	}
+	rawName, err := ioutil.ReadFile(path.Join(dir, "name"))
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Open all parts upfront so that a missing part is detected before
+	// anything is sent to the store
+	mr := &multiFileReader{}
+	for _, p := range parts {
+		f, err := os.Open(path.Join(dir, strconv.Itoa(p.number)+"."+p.etag))
+		if err != nil {
+			mr.Close()
+			return "", nil, fmt.Errorf("Missing part %d", p.number)
+		}
+		mr.files = append(mr.files, f)
+	}
+	return string(rawName), mr, nil
+}
+
+// abort removes the session and all its parts
+func (us uploadSessions) abort(id string) error {
+	dir, err := us.sessionDir(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// expire removes the sessions initiated before the given time, along
+// with their parts, and returns how many were removed
+func (us uploadSessions) expire(before time.Time) (removed int, err error) {
+	sessions, err := ioutil.ReadDir(us.root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, session := range sessions {
+		if !session.IsDir() {
+			continue
+		}
+		dir := path.Join(us.root, session.Name())
+		info, err := os.Stat(path.Join(dir, "name"))
+		if err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// multiFileReader reads files one after the other, like
+// io.MultiReader, and closes all of them when closed
+type multiFileReader struct {
+	files []*os.File
+	cur   int
+}
+
+func (mr *multiFileReader) Read(p []byte) (n int, err error) {
+	for mr.cur < len(mr.files) {
+		n, err = mr.files[mr.cur].Read(p)
+		if err == io.EOF {
+			mr.cur++
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+	return 0, io.EOF
+}
+
+func (mr *multiFileReader) Close() error {
+	for _, f := range mr.files {
+		f.Close()
+	}
+	return nil
+}
+
+// isUploadRequest tells whether the request is part of a multi-part
+// upload session rather than a plain request on a file
+func isUploadRequest(r *http.Request) bool {
+	q := r.URL.Query()
+	_, initiate := q["uploads"]
+	return initiate || q.Get("uploadId") != ""
+}
+
+// handleUpload dispatches requests related to multi-part upload
+// sessions:
+//
+// - POST /?uploads&name=<name> initiates a session
+// - PUT /?uploadId=<id>&partNumber=<n> sends a part
+// - POST /?uploadId=<id> completes the session with the list of parts
+// - DELETE /?uploadId=<id> aborts the session
+//
+// Note that the query is read directly from the URL: the body of the
+// completion request is the list of parts, not a form to be parsed.
+func (h handler) handleUpload(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("uploadId")
+	_, initiate := q["uploads"]
+
+	// Sessions can only be used by whoever initiated them (or an admin);
+	// to others they don't exist
+	var owner string
+	if id != "" {
+		var err error
+		owner, err = h.uploads.owner(id)
+		p, _ := principalFrom(r)
+		if err != nil || (owner != p.name && !p.scopes.allows(scopeAdmin)) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == "POST" && initiate && id == "":
+		h.handleUploadCreate(w, r, q.Get("name"))
+	case r.Method == "PUT" && !initiate && id != "":
+		h.handleUploadPart(w, r, id, owner, q.Get("partNumber"))
+	case r.Method == "POST" && !initiate:
+		h.handleUploadComplete(w, r, id)
+	case r.Method == "DELETE" && !initiate:
+		h.handleUploadAbort(w, r, id)
+	default:
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+	}
+}
+
+func (h handler) handleUploadCreate(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	p, _ := principalFrom(r)
+	id, err := h.uploads.create(name, p.name)
+	if err != nil {
+		logError(r, "Error creating upload session:", err)
+		http.Error(w, "Error creating upload session", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/?uploadId="+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h handler) handleUploadPart(w http.ResponseWriter, r *http.Request, id, owner, partNumber string) {
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > maxPartNumber {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !h.limitBody(w, r) {
+		r.Body.Close()
+		return
+	}
+	rd, err := h.partQuota(owner, r)
+	if err != nil {
+		r.Body.Close()
+		postError(w, r, err)
+		return
+	}
+	etag, err := h.uploads.putPart(id, n, rd)
+	r.Body.Close()
+	if err == errInvalidSession {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if status := quotaStatus(err); status != 0 {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if bodyError(w, err) {
+		return
+	}
+	if err != nil {
+		logError(r, "Error putting part:", err)
+		http.Error(w, "Error putting part", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Etag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h handler) handleUploadComplete(w http.ResponseWriter, r *http.Request, id string) {
+	m, err := uploadMeta(r, time.Now())
+	if err != nil {
+		r.Body.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parts, err := parseParts(io.LimitReader(r.Body, maxPartNumber*128))
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Invalid part list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, rd, err := h.uploads.complete(id, parts)
+	if err == errInvalidSession {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Parts are limited one by one, the whole file must be too
+	if limit := h.uploadLimit(r); limit > 0 {
+		rd = http.MaxBytesReader(w, rd, limit)
+	}
+	if h.disk != nil {
+		rd = h.disk.reader(rd)
+	}
+	res, err := h.post(name, rd, m)
+	rd.Close()
+	if err != nil {
+		postError(w, r, err)
+		return
+	}
+	if err := h.uploads.abort(id); err != nil {
+		logError(r, "Couldn't remove upload session:", err)
+	}
+	writePostResult(w, res)
+}
+
+func (h handler) handleUploadAbort(w http.ResponseWriter, r *http.Request, id string) {
+	err := h.uploads.abort(id)
+	if err == errInvalidSession {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(r, "Couldn't abort upload session:", err)
+		http.Error(w, "Couldn't abort upload session", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
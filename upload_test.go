@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doRequest(t *testing.T, method, targetUrl string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, targetUrl, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestMultipartUpload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	st := newDummyStore()
+	h := handler{st: st, uploads: uploadSessions{tmp}}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	res := doRequest(t, "POST", ts.URL+"/?uploads&name=parts.txt", nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("[initiate] got status %d, expected %d", res.StatusCode, http.StatusCreated)
+	}
+	location, _ := url.Parse(res.Header.Get("Location"))
+	id := location.Query().Get("uploadId")
+	if id == "" {
+		t.Fatalf("[initiate] no uploadId in Location %s", res.Header.Get("Location"))
+	}
+
+	// Send parts out of order, to check that the part list alone
+	// decides the final order
+	contents := []string{"first part, ", "second part, ", "third part"}
+	etags := make([]string, len(contents))
+	for _, i := range []int{2, 0, 1} {
+		res := doRequest(t, "PUT", fmt.Sprintf("%s/?uploadId=%s&partNumber=%d", ts.URL, id, i+1), []byte(contents[i]))
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("[part %d] got status %d, expected %d", i+1, res.StatusCode, http.StatusOK)
+		}
+		etags[i] = res.Header.Get("Etag")
+	}
+
+	// A part list referring to an unknown etag is rejected
+	bogus := fmt.Sprintf("1 %s\n", strings.Repeat("0", 64))
+	res = doRequest(t, "POST", ts.URL+"/?uploadId="+id, []byte(bogus))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("[complete] got status %d for unknown part, expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	var list bytes.Buffer
+	for i, etag := range etags {
+		fmt.Fprintf(&list, "%d %s\n", i+1, etag)
+	}
+	res = doRequest(t, "POST", ts.URL+"/?uploadId="+id, list.Bytes())
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("[complete] got status %d, expected %d", res.StatusCode, http.StatusCreated)
+	}
+	location, _ = url.Parse(res.Header.Get("Location"))
+	f, ok := st.files[location.Query().Get("name")]
+	if !ok {
+		t.Fatalf("[complete] file not found in store at %s", res.Header.Get("Location"))
+	}
+	if expected := strings.Join(contents, ""); string(f.content) != expected {
+		t.Fatalf("[complete] got content %q, expected %q", f.content, expected)
+	}
+
+	// The session is gone once completed
+	if _, err := os.Stat(path.Join(tmp, id)); !os.IsNotExist(err) {
+		t.Fatalf("[complete] session directory still exists: %v", err)
+	}
+	res = doRequest(t, "DELETE", ts.URL+"/?uploadId="+id, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("[abort] got status %d for completed session, expected %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestMultipartUploadDedupBoundaries(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := dedupStore{root: path.Join(tmp, "data")}
+	us := uploadSessions{path.Join(tmp, "uploads")}
+
+	content := make([]byte, 200000)
+	rand.New(rand.NewSource(42)).Read(content)
+
+	single, err := ds.Post("single", bytes.NewReader(content), time.Now(), meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Split content at arbitrary places, unrelated to chunk boundaries
+	id, err := us.create("multi", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []part
+	for i, bounds := range [][2]int{{0, 1000}, {1000, 123457}, {123457, len(content)}} {
+		etag, err := us.putPart(id, i+1, bytes.NewReader(content[bounds[0]:bounds[1]]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part{number: i + 1, etag: etag})
+	}
+	name, rd, err := us.complete(id, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, err := ds.Post(name, rd, time.Now(), meta{})
+	rd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunkList := func(name string) string {
+		b, err := ioutil.ReadFile(path.Join(ds.root, name[:2], name[2:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	singleChunks, multiChunks := chunkList(single), chunkList(multi)
+	if strings.Count(singleChunks, "\n") == 0 {
+		t.Fatal("content was not split into several chunks")
+	}
+	if singleChunks != multiChunks {
+		t.Fatalf("got different chunks for multi-part upload:\n%s\nexpected:\n%s", multiChunks, singleChunks)
+	}
+}
+
+func TestUploadSessionsExpire(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "httpfile-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	us := uploadSessions{tmp}
+
+	var ids []string
+	for _, name := range []string{"abandoned", "recent"} {
+		id, err := us.create(name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := us.putPart(id, 1, strings.NewReader("part")); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(path.Join(tmp, ids[0], "name"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := us.expire(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed %d sessions, expected 1", removed)
+	}
+	if _, err := os.Stat(path.Join(tmp, ids[0])); !os.IsNotExist(err) {
+		t.Fatalf("abandoned session still there: %v", err)
+	}
+	if _, err := us.owner(ids[1]); err != nil {
+		t.Fatalf("recent session removed: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// retention tells which versions of a stable name are kept once they
+// are not current anymore. The current version is always kept. On a
+// dedupStore, versions share the chunks they have in common, so keeping
+// many of them costs little.
+type retention struct {
+	// keep is the number of versions kept, including the current one;
+	// 0 means no limit
+	keep int
+
+	// keepFor is how long versions are kept after being created; 0
+	// means forever
+	keepFor time.Duration
+}
+
+// prune splits versions, oldest first, into the ones kept and the ones
+// pruned at the given time
+func (rt retention) prune(versions []version, now time.Time) (kept, pruned []version) {
+	for i, v := range versions {
+		current := i == len(versions)-1
+		tooMany := rt.keep > 0 && len(versions)-i > rt.keep
+		tooOld := rt.keepFor > 0 && now.Sub(v.Created) > rt.keepFor
+		if !current && (tooMany || tooOld) {
+			pruned = append(pruned, v)
+		} else {
+			kept = append(kept, v)
+		}
+	}
+	return kept, pruned
+}
+
+// pruneVersions applies the retention to all the stable names of st,
+// also forgetting the old versions whose object expired or was deleted.
+// It returns the number of versions pruned.
+func pruneVersions(st store, rt retention, now time.Time) (int, error) {
+	n, ok := underlying(st).(namer)
+	if !ok {
+		return 0, nil
+	}
+	var names []string
+	err := n.WalkNames(func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, name := range names {
+		nameLock.Lock()
+		versions, err := n.Versions(name)
+		if os.IsNotExist(err) {
+			// deleted in the meantime
+			nameLock.Unlock()
+			continue
+		}
+		if err != nil {
+			nameLock.Unlock()
+			return pruned, err
+		}
+		kept, old := rt.prune(versions, now)
+		live := kept[:0:0]
+		for i, v := range kept {
+			if _, err := st.Meta(v.Object); os.IsNotExist(err) && i != len(kept)-1 {
+				continue
+			}
+			live = append(live, v)
+		}
+		if len(live) != len(versions) {
+			err = n.SetVersions(name, live)
+		}
+		nameLock.Unlock()
+		if err != nil {
+			return pruned, err
+		}
+		for _, v := range old {
+			if err := st.Delete(v.Object); err != nil && !os.IsNotExist(err) {
+				log.Printf("Couldn't delete old version %s of %s: %v", v.id(), name, err)
+			}
+		}
+		pruned += len(versions) - len(live)
+	}
+	return pruned, nil
+}
+
+// runPruner applies the retention every interval, forever. It is meant
+// to be run in its own goroutine.
+func runPruner(st store, rt retention, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := pruneVersions(st, rt, time.Now())
+		if err != nil {
+			log.Println("Error pruning versions:", err)
+		}
+		if n > 0 {
+			log.Printf("Pruned %d version(s)", n)
+		}
+	}
+}
+
+// versionEntry describes a version in a listing
+type versionEntry struct {
+	Version string    `json:"version"`
+	Created time.Time `json:"created,omitzero"`
+	Size    int64     `json:"size"`
+	Current bool      `json:"current"`
+}
+
+// isVersionsRequest tells whether the request asks for the versions of
+// a stable name
+func isVersionsRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["versions"]
+	return r.Method == "GET" && ok
+}
+
+// handleVersions sends the JSON list of the versions of the stable name
+// given by the name parameter, newest first. Versions whose object
+// expired or was deleted are left out.
+func (h handler) handleVersions(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !validStableName(name) {
+		http.Error(w, "Invalid name", http.StatusBadRequest)
+		return
+	}
+	n, ok := underlying(h.st).(namer)
+	if !ok {
+		http.Error(w, "Stable names are not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	versions, err := n.Versions(name)
+	if os.IsNotExist(err) || err == errNameConflict {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError(r, "Couldn't read versions:", err)
+		http.Error(w, "Error listing versions", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	entries := make([]versionEntry, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		m, err := h.st.Meta(v.Object)
+		if os.IsNotExist(err) || (err == nil && m.expired(now)) {
+			continue
+		}
+		if err != nil {
+			logError(r, "Couldn't read metadata:", err)
+			http.Error(w, "Error listing versions", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, versionEntry{
+			Version: v.id(),
+			Created: v.Created,
+			Size:    m.Size,
+			Current: i == len(versions)-1,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// deleteVersions deletes the version of a stable name given by the
+// version parameter, the previous one becoming current if it was, or
+// else all of them along with the name. It needs the rights to delete
+// the version, or the current one when deleting them all. It must be
+// called with nameLock held.
+func (h handler) deleteVersions(w http.ResponseWriter, r *http.Request, n namer, name string, versions []version) {
+	target := len(versions) - 1
+	if id := r.Form.Get("version"); id != "" {
+		target = -1
+		for i, v := range versions {
+			if v.id() == id {
+				target = i
+			}
+		}
+		if target < 0 {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+	}
+	m, err := h.st.Meta(versions[target].Object)
+	if err != nil && !os.IsNotExist(err) {
+		logError(r, "Couldn't delete:", err)
+		http.Error(w, "Couldn't delete", http.StatusInternalServerError)
+		return
+	}
+	if err == nil && !canDelete(r, m) {
+		http.Error(w, "Invalid delete token", http.StatusForbidden)
+		return
+	}
+
+	deleted := versions
+	kept := []version{}
+	if r.Form.Get("version") != "" {
+		deleted = versions[target : target+1]
+		kept = append(append(kept, versions[:target]...), versions[target+1:]...)
+	}
+	if err := n.SetVersions(name, kept); err != nil {
+		logError(r, "Couldn't delete:", err)
+		http.Error(w, "Couldn't delete", http.StatusInternalServerError)
+		return
+	}
+	for _, v := range deleted {
+		if err := h.st.Delete(v.Object); err != nil && !os.IsNotExist(err) {
+			logError(r, "Couldn't delete version:", err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
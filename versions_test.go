@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersions(t *testing.T) {
+	withStores(t, func(t *testing.T, st store, root string) {
+		ts := httptest.NewServer(handler{st: st})
+		defer ts.Close()
+		const name = "project/latest.tar.gz"
+
+		get := func(query string) (string, int) {
+			res, err := http.Get(ts.URL + "/?name=" + name + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			return string(content), res.StatusCode
+		}
+		list := func() []versionEntry {
+			res, err := http.Get(ts.URL + "/?versions&name=" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			var entries []versionEntry
+			if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+				t.Fatal(err)
+			}
+			return entries
+		}
+		del := func(query, token string) int {
+			req, _ := http.NewRequest("DELETE", ts.URL+"/?name="+name+query, nil)
+			req.Header.Set(deleteTokenHeader, token)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			return res.StatusCode
+		}
+
+		var ids, tokens []string
+		token := ""
+		for _, content := range []string{"build 1", "build 2", "build 3"} {
+			res := put(t, ts.URL, name, content, map[string]string{deleteTokenHeader: token})
+			token = res.Header.Get(deleteTokenHeader)
+			ids = append(ids, strings.Trim(res.Header.Get("Etag"), `"`))
+			tokens = append(tokens, token)
+		}
+
+		entries := list()
+		if len(entries) != 3 {
+			t.Fatalf("got %d versions, expected 3", len(entries))
+		}
+		for i, e := range entries {
+			if e.Version != ids[2-i] || e.Current != (i == 0) || e.Size != 7 {
+				t.Fatalf("got version %+v at %d, expected %s", e, i, ids[2-i])
+			}
+		}
+		if content, _ := get("&version=" + ids[0]); content != "build 1" {
+			t.Fatalf("got %q for the first version, expected build 1", content)
+		}
+		if _, status := get("&version=unknown"); status != http.StatusNotFound {
+			t.Fatalf("got status %d for an unknown version, expected %d", status, http.StatusNotFound)
+		}
+
+		// Deleting a version needs its own delete token
+		if status := del("&version="+ids[1], tokens[2]); status != http.StatusForbidden {
+			t.Fatalf("got status %d with another token, expected %d", status, http.StatusForbidden)
+		}
+		if status := del("&version="+ids[1], tokens[1]); status != http.StatusOK {
+			t.Fatalf("got status %d deleting a version, expected %d", status, http.StatusOK)
+		}
+		// Deleting the current version makes the previous one current
+		if status := del("&version="+ids[2], tokens[2]); status != http.StatusOK {
+			t.Fatalf("got status %d deleting the current version, expected %d", status, http.StatusOK)
+		}
+		if content, _ := get(""); content != "build 1" {
+			t.Fatalf("got %q, expected build 1", content)
+		}
+		if entries := list(); len(entries) != 1 || !entries[0].Current {
+			t.Fatalf("got versions %+v, expected the first one only", entries)
+		}
+
+		if status := del("", tokens[0]); status != http.StatusOK {
+			t.Fatalf("got status %d deleting the name, expected %d", status, http.StatusOK)
+		}
+		res, err := http.Get(ts.URL + "/?versions&name=" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("got status %d listing a deleted name, expected %d", res.StatusCode, http.StatusNotFound)
+		}
+		objects := 0
+		st.Walk(func(string, meta) error {
+			objects++
+			return nil
+		})
+		if objects != 0 {
+			t.Fatalf("got %d objects left, expected none", objects)
+		}
+	})
+}
+
+func TestRetentionPrune(t *testing.T) {
+	now := time.Now()
+	versions := []version{
+		{"a/1", now.Add(-72 * time.Hour)},
+		{"b/2", now.Add(-48 * time.Hour)},
+		{"c/3", now.Add(-time.Hour)},
+		{"d/4", now.Add(-36 * time.Hour)},
+	}
+	for _, test := range []struct {
+		rt     retention
+		pruned []version
+	}{
+		{retention{}, nil},
+		{retention{keep: 2}, versions[:2]},
+		{retention{keepFor: 24 * time.Hour}, versions[:2]},
+		{retention{keep: 3, keepFor: 60 * time.Hour}, versions[:1]},
+		// The current version is kept however old it is
+		{retention{keep: 1, keepFor: time.Minute}, versions[:3]},
+	} {
+		kept, pruned := test.rt.prune(versions, now)
+		if !reflect.DeepEqual(pruned, test.pruned) || len(kept)+len(pruned) != len(versions) {
+			t.Errorf("got %v pruned with %+v, expected %v", pruned, test.rt, test.pruned)
+		}
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	withStores(t, func(t *testing.T, st store, root string) {
+		ts := httptest.NewServer(handler{st: st, retention: retention{keep: 2}})
+		defer ts.Close()
+		const name = "project/latest.tar.gz"
+
+		token := ""
+		for _, content := range []string{"build 1", "build 2", "build 3"} {
+			res := put(t, ts.URL, name, content, map[string]string{deleteTokenHeader: token})
+			token = res.Header.Get(deleteTokenHeader)
+		}
+		versions, err := st.(namer).Versions(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 {
+			t.Fatalf("got %d versions after uploads, expected 2", len(versions))
+		}
+
+		// Versions get too old, and those whose object is gone are
+		// forgotten
+		if err := st.Delete(versions[0].Object); err != nil {
+			t.Fatal(err)
+		}
+		n, err := pruneVersions(st, retention{keepFor: time.Hour}, time.Now().Add(2*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("pruned %d versions, expected 1", n)
+		}
+		pruned, _ := st.(namer).Versions(name)
+		if len(pruned) != 1 || pruned[0] != versions[1] {
+			t.Fatalf("got versions %v, expected the current one only", pruned)
+		}
+		objects := 0
+		st.Walk(func(string, meta) error {
+			objects++
+			return nil
+		})
+		if objects != 1 {
+			t.Fatalf("got %d objects, expected 1", objects)
+		}
+	})
+}